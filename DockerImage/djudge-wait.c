@@ -0,0 +1,91 @@
+/*
+ * djudge-wait runs the program of a testcase as the run user and records
+ * how it ended. A shell only tells exit code 128+N for a program killed by
+ * signal N, which the program can just as well exit with
+ *
+ * usage: djudge-wait <status file> <user> <output limit in KB> <program> [args...]
+ *
+ * The status file gets "exited <code>" or "signaled <signal>", it is written
+ * by root so the program can not fake it. The user and the file size limit
+ * (0 for none) only apply to the program. The exit code is the one of the
+ * program, 128+N if it is killed by signal N, as a shell does
+ */
+#include <errno.h>
+#include <grp.h>
+#include <pwd.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sys/resource.h>
+#include <sys/types.h>
+#include <sys/wait.h>
+#include <unistd.h>
+
+#define EXIT_HELPER 125 /* djudge-wait itself failed */
+
+int main(int argc, char *argv[])
+{
+	struct passwd *pw = NULL;
+	long long limit;
+	pid_t pid;
+	int status;
+	FILE *f;
+
+	if (argc < 5) {
+		fprintf(stderr, "usage: %s <status file> <user> <output limit in KB> <program> [args...]\n", argv[0]);
+		return EXIT_HELPER;
+	}
+	limit = atoll(argv[3]);
+	if (strcmp(argv[2], "root") != 0) {
+		pw = getpwnam(argv[2]);
+		if (pw == NULL) {
+			fprintf(stderr, "djudge-wait: no user %s\n", argv[2]);
+			return EXIT_HELPER;
+		}
+	}
+
+	pid = fork();
+	if (pid < 0) {
+		perror("djudge-wait: fork");
+		return EXIT_HELPER;
+	}
+	if (pid == 0) {
+		if (limit > 0) {
+			struct rlimit rl = {limit * 1024, limit * 1024};
+			if (setrlimit(RLIMIT_FSIZE, &rl) < 0) {
+				perror("djudge-wait: set output limit");
+				_exit(EXIT_HELPER);
+			}
+		}
+		if (pw != NULL && (initgroups(pw->pw_name, pw->pw_gid) < 0 || setgid(pw->pw_gid) < 0 || setuid(pw->pw_uid) < 0)) {
+			perror("djudge-wait: switch user");
+			_exit(EXIT_HELPER);
+		}
+		execvp(argv[4], argv + 4);
+		perror("djudge-wait: exec");
+		_exit(127);
+	}
+
+	while (waitpid(pid, &status, 0) < 0) {
+		if (errno != EINTR) {
+			perror("djudge-wait: wait");
+			return EXIT_HELPER;
+		}
+	}
+	f = fopen(argv[1], "w");
+	if (f == NULL) {
+		perror("djudge-wait: open status file");
+		return EXIT_HELPER;
+	}
+	if (WIFSIGNALED(status))
+		fprintf(f, "signaled %d\n", WTERMSIG(status));
+	else
+		fprintf(f, "exited %d\n", WEXITSTATUS(status));
+	if (fclose(f) != 0) {
+		perror("djudge-wait: write status file");
+		return EXIT_HELPER;
+	}
+	if (WIFSIGNALED(status))
+		return 128 + WTERMSIG(status);
+	return WEXITSTATUS(status);
+}
@@ -9,40 +9,113 @@ const (
 	ResAC  = "correct"
 	ResCE  = "compiler-error"
 	ResRE  = "run-error"
+	ResMLE = "memory-limit"
+	ResOLE = "output-limit"
+	ResNO  = "no-output"
+	ResPE  = "presentation-error"
+	ResRF  = "restricted-function"
+)
+
+// Scoring policies, with the default ICPC policy the judging stops at the
+// first failed testcase. With sum every testcase scores its points, with
+// group a group of testcases scores only what its worst testcase scores and
+// the rest of a group is skipped once it scores nothing
+const (
+	ScoringICPC  = ""
+	ScoringSum   = "sum"
+	ScoringGroup = "group"
+)
+
+// Sandbox backends, docker by default. The namespace backend runs the
+// containers itself with namespaces, cgroup v2 and seccomp
+const (
+	SandboxDocker    = "docker"
+	SandboxNamespace = "namespace"
 )
 
 type SystemConfig struct {
-	HostName         string `toml:"host_name"`
-	EndpointUser     string `toml:"endpoint_user"`
-	EndpointName     string `toml:"endpoint_name"`
-	EndpointURL      string `toml:"endpoint_url"`
-	MaxCacheSize     int    `toml:"max_cache_size"`
-	EndpointPassword string `toml:"endpoint_password"`
-	JudgeRoot        string `toml:"judge_root"`
-	DockerImage      string `toml:"docker_image"`
-	DockerServer     string `toml:"docker_server"`
-	DockerVersion    string `toml:"docker_version"`
-	CacheRoot        string `toml:"cache_root"`
-	RootMemory       int64  `toml:"root_mem"`
+	HostName         string  `toml:"host_name"`
+	EndpointUser     string  `toml:"endpoint_user"`
+	EndpointName     string  `toml:"endpoint_name"`
+	EndpointType     string  `toml:"endpoint_type"`
+	EndpointURL      string  `toml:"endpoint_url"`
+	MaxCacheSize     int     `toml:"max_cache_size"`
+	MaxDownloadSize  int64   `toml:"max_download_size"`
+	PrefetchWorkers  int     `toml:"prefetch_workers"`
+	EndpointPassword string  `toml:"endpoint_password"`
+	JudgeRoot        string  `toml:"judge_root"`
+	DockerImage      string  `toml:"docker_image"`
+	DockerServer     string  `toml:"docker_server"`
+	DockerVersion    string  `toml:"docker_version"`
+	CacheRoot        string  `toml:"cache_root"`
+	LocalExecRoot    string  `toml:"local_exec_root"`
+	RootMemory       int64   `toml:"root_mem"`
+	CPUTimeFactor    float64 `toml:"cpu_time_factor"`
+	WallTimeFactor   float64 `toml:"wall_time_factor"`
+	ResumeJudgings   bool    `toml:"resume_judgings"`
+	DrainTimeout     int64   `toml:"drain_timeout"`
+	JudgeCPUs        []int   `toml:"judge_cpus"`
+	ReservedCPUs     []int   `toml:"reserved_cpus"`
+	WarmContainers   int     `toml:"warm_containers"`
+	ContainerMaxUses int     `toml:"container_max_uses"`
+	RunUser          string  `toml:"run_user"`
+	Sandbox          string  `toml:"sandbox"`
+	SandboxRootfs    string  `toml:"sandbox_rootfs"`
+	SandboxCgroup    string  `toml:"sandbox_cgroup"`
+
+	// Pools of workers, one pool of all judge_cpus if empty
+	Pools []PoolConfig `toml:"pool"`
+
+	// Security profiles of the languages, by language id
+	Security map[string]SecurityProfile `toml:"security"`
+}
+
+// SecurityProfile changes the default syscalls the program is killed for
+// and the default capabilities kept in the container for a language
+type SecurityProfile struct {
+	Deny   []string `toml:"deny"`  // Syscalls denied besides the default ones
+	Allow  []string `toml:"allow"` // Default denied syscalls allowed
+	CapAdd []string `toml:"cap_add"`
+}
+
+// PoolConfig is a pool of workers sharing the same resource profile, zero
+// values fall back to the global settings. A judging goes to the pool with
+// the highest MinTimeLimit not above its time limit, or a lower one if that
+// is busy
+type PoolConfig struct {
+	Name         string  `toml:"name"`
+	Workers      int     `toml:"workers"` // One core each, all cores of the pool if 0
+	CPUs         []int   `toml:"cpus"`
+	RootMemory   int64   `toml:"root_mem"`
+	PidsLimit    int64   `toml:"pids_limit"`
+	DockerImage  string  `toml:"docker_image"`
+	MinTimeLimit float64 `toml:"min_time_limit"` // In seconds
 }
 
+// JudgeInfo describes a judging, TimeLimit is in seconds and can be
+// fractional, MemLimit and OutputLimit are in KB as DOMjudge does
 type JudgeInfo struct {
-	SubmitID      int64  `json:"submitid"`
-	ContestID     int64  `json:"cid"`
-	TeamID        int64  `json:"teamid"`
-	JudgingID     int64  `json:"judgingid"`
-	ProblemID     int64  `json:"probid"`
-	Language      string `json:"langid"`
-	TimeLimit     int64  `json:"maxruntime"`
-	MemLimit      int64  `json:"memlimit"`
-	OutputLimit   int64  `json:"output_limit"`
-	BuildZip      string `json:"compile_script"`
-	BuildZipMD5   string `json:"compile_script_md5sum"`
-	RunZip        string `json:"run"`
-	RunZipMD5     string `json:"run_md5sum"`
-	CompareZip    string `json:"compare"`
-	CompareZipMD5 string `json:"compare_md5sum"`
-	CompareArgs   string `json:"compare_args"`
+	SubmitID      int64   `json:"submitid"`
+	ContestID     int64   `json:"cid"`
+	TeamID        int64   `json:"teamid"`
+	JudgingID     int64   `json:"judgingid"`
+	ProblemID     int64   `json:"probid"`
+	Language      string  `json:"langid"`
+	TimeLimit     float64 `json:"maxruntime"`
+	MemLimit      int64   `json:"memlimit"`
+	OutputLimit   int64   `json:"output_limit"`
+	BuildZip      string  `json:"compile_script"`
+	BuildZipMD5   string  `json:"compile_script_md5sum"`
+	RunZip        string  `json:"run"`
+	RunZipMD5     string  `json:"run_md5sum"`
+	CompareZip    string  `json:"compare"`
+	CompareZipMD5 string  `json:"compare_md5sum"`
+	CompareArgs   string  `json:"compare_args"`
+	// CombinedRunCompare marks an interactive problem, the compare
+	// executable is the interactor talking with the program
+	CombinedRunCompare bool `json:"combined_run_compare"`
+	// Scoring is the scoring policy of the problem
+	Scoring string `json:"scoring"`
 }
 
 type TestcaseInfo struct {
@@ -51,6 +124,11 @@ type TestcaseInfo struct {
 	ProblemID    int64  `json:"probid"`
 	MD5SumInput  string `json:"md5sum_input"`
 	MD5SumOutput string `json:"md5sum_output"`
+	Hash         string `json:"testcase_hash"`
+	JudgeTaskID  int64  `json:"judgetaskid"`
+	// Group and Points are used by partial scoring, points are 1 if not given
+	Group  string  `json:"group"`
+	Points float64 `json:"points"`
 }
 
 type SubmissionInfo struct {
@@ -62,13 +140,21 @@ type SubmissionFileInfo struct {
 	Content  string `json:"contetn"`
 }
 
+// RunResult is the result of a testcase run, RunTime is the CPU time
+// reported to the server, times are in seconds
 type RunResult struct {
 	JudgingID    int64
 	TestcaseID   int64
+	JudgeTaskID  int64
 	RunResult    string
 	RunTime      float64
+	CPUTime      float64
+	WallTime     float64
+	ExitCode     int // Exit code of the program, 128+N when killed by signal N
+	Signal       int // Signal terminated the program, 0 if exited normally
 	OutputRun    string
 	OutputError  string
 	OutputSystem string
 	OutputDiff   string
+	Score        float64 // Points scored by the run with partial scoring
 }
@@ -0,0 +1,382 @@
+package downloader
+
+// The download cache, a content-addressed store bounded by max_cache_size
+// with LRU eviction
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/VOID001/D-judge/config"
+	"github.com/pkg/errors"
+)
+
+// CacheIndex is the index file in the cache root, it keeps the size and
+// the last use of the entries so they need not be read again on startup
+const CacheIndex = "index.json"
+
+// CacheIndexFlushInterval is how often the index is saved for the last uses
+// of the hits, it is saved right away when an entry is added or removed
+const CacheIndexFlushInterval = time.Minute
+
+// Hash algorithms of the cache keys, a file is stored as <algo>/<hex sum>
+const (
+	HashMD5    = "md5"
+	HashSHA256 = "sha256"
+)
+
+// hashLen is the length of the hex sum of the algorithms
+var hashLen = map[string]int{HashMD5: 32, HashSHA256: 64}
+
+// Cache keeps the downloaded files under root by their checksum, so the
+// same file of different testcases or executables is stored once. The
+// entries are trusted by their name and size, they are not hashed again.
+// The least recently used entries are evicted when the total size is over
+// max, the files linked into the work dirs are still there until the
+// judgings are done with them
+type Cache struct {
+	mu      sync.Mutex
+	root    string
+	max     int64 // In bytes, 0 for no limit
+	size    int64
+	entries map[string]*list.Element // Of *cacheEntry by key, the front is the most recently used
+	lru     *list.List
+	loading map[string]chan struct{} // Closed when the download of the key is done
+	dirty   bool                     // The index is not saved since a hit
+	saved   time.Time
+}
+
+type cacheEntry struct {
+	Key  string `json:"key"` // <algo>/<hex sum>
+	Size int64  `json:"size"`
+	Used int64  `json:"used"` // Unix time in nanoseconds
+}
+
+var (
+	cacheOnce sync.Once
+	cache     *Cache
+	cacheErr  error
+)
+
+// defaultCache opens the cache of the config once
+func defaultCache() (*Cache, error) {
+	cacheOnce.Do(func() {
+		cache, cacheErr = OpenCache(config.GlobalConfig.CacheRoot, int64(config.GlobalConfig.MaxCacheSize))
+	})
+	return cache, cacheErr
+}
+
+// FlushCache saves the index of the cache of the config if it is open, no
+// download should be in progress. The cache can not be opened after it
+func FlushCache() (err error) {
+	cacheOnce.Do(func() {})
+	if cache == nil {
+		return
+	}
+	err = cache.Flush()
+	return
+}
+
+// cacheKey returns the key of the file with the checksum, the checksum
+// comes from the judge server so it is checked to be a hex sum
+func cacheKey(algo string, sum string) (key string, err error) {
+	n, ok := hashLen[algo]
+	if !ok {
+		err = errors.New(fmt.Sprintf("unknown hash algorithm %s", algo))
+		return
+	}
+	sum = strings.ToLower(sum)
+	if len(sum) != n || strings.Trim(sum, "0123456789abcdef") != "" {
+		err = errors.New(fmt.Sprintf("bad %s checksum %q", algo, sum))
+		return
+	}
+	key = algo + "/" + sum
+	return
+}
+
+// OpenCache opens the cache in root. The entries are read from the index,
+// the files not in the index (left by a crash) are taken in by their
+// names, and the name dirs of older versions are moved to their checksums
+func OpenCache(root string, max int64) (c *Cache, err error) {
+	c = &Cache{
+		root:    root,
+		max:     max,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		loading: make(map[string]chan struct{}),
+	}
+	for algo := range hashLen {
+		err = os.MkdirAll(filepath.Join(root, algo), DirPerm)
+		if err != nil {
+			err = errors.Wrap(err, "open cache error")
+			return
+		}
+	}
+	err = c.migrate()
+	if err != nil {
+		err = errors.Wrap(err, "open cache error")
+		return
+	}
+	index := []cacheEntry{}
+	data, err := ioutil.ReadFile(filepath.Join(root, CacheIndex))
+	if err == nil {
+		err = json.Unmarshal(data, &index)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("cache index is broken, rebuild it: %s", err)
+	}
+	err = nil
+	used := make(map[string]int64)
+	for _, e := range index {
+		used[e.Key] = e.Used
+	}
+
+	found := []cacheEntry{}
+	for algo := range hashLen {
+		files, er := ioutil.ReadDir(filepath.Join(root, algo))
+		if er != nil {
+			err = errors.Wrap(er, "open cache error")
+			return
+		}
+		for _, f := range files {
+			key, er := cacheKey(algo, f.Name())
+			if er != nil || !f.Mode().IsRegular() {
+				os.RemoveAll(filepath.Join(root, algo, f.Name()))
+				continue
+			}
+			e := cacheEntry{Key: key, Size: f.Size(), Used: f.ModTime().UnixNano()}
+			if u, ok := used[key]; ok {
+				e.Used = u
+			}
+			found = append(found, e)
+		}
+	}
+	// The most recently used to the front
+	sort.Slice(found, func(i, j int) bool { return found[i].Used > found[j].Used })
+	for i := range found {
+		c.entries[found[i].Key] = c.lru.PushBack(&found[i])
+		c.size += found[i].Size
+	}
+	c.evict("")
+	err = c.save()
+	if err != nil {
+		err = errors.Wrap(err, "open cache error")
+		return
+	}
+	return
+}
+
+// migrate moves the <name>/content files of older versions to their md5
+// sums found in <name>/checksum
+func (c *Cache) migrate() (err error) {
+	files, err := ioutil.ReadDir(c.root)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if _, ok := hashLen[f.Name()]; ok || !f.IsDir() {
+			continue
+		}
+		dir := filepath.Join(c.root, f.Name())
+		sum, er := ioutil.ReadFile(filepath.Join(dir, CacheChecksum))
+		if er == nil {
+			key, er := cacheKey(HashMD5, strings.TrimSpace(string(sum)))
+			if er == nil {
+				os.Rename(filepath.Join(dir, CacheContent), filepath.Join(c.root, key))
+			}
+		}
+		os.RemoveAll(dir)
+	}
+	return
+}
+
+// Fetch links the file with the checksum in the cache to dest, it is
+// downloaded to dest by download and put into the cache if not cached.
+// Only one download of the same file is done at a time, the others wait
+// for it
+func (c *Cache) Fetch(ctx context.Context, algo string, sum string, dest string, download func(dest string) error) (err error) {
+	key, err := cacheKey(algo, sum)
+	if err != nil {
+		err = errors.Wrap(err, "fetch from cache error")
+		return
+	}
+	for {
+		c.mu.Lock()
+		if path := c.lookup(key); path != "" {
+			// Linked before unlocking, or it may be evicted in between
+			err = os.Link(path, dest)
+			c.mu.Unlock()
+			if err != nil {
+				err = errors.Wrap(err, "fetch from cache error")
+			}
+			return
+		}
+		done, ok := c.loading[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = errors.Wrap(ctx.Err(), "fetch from cache error")
+			return
+		}
+	}
+	done := make(chan struct{})
+	c.loading[key] = done
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.loading, key)
+		c.mu.Unlock()
+		close(done)
+	}()
+
+	err = download(dest)
+	if err != nil {
+		return
+	}
+	// Failing to save into the cache is not fatal
+	er := c.add(key, dest)
+	if er != nil {
+		log.Errorf("save into cache failed, error %+v", er)
+	}
+	return
+}
+
+// lookup returns the file of the entry if it is there, and marks it used
+func (c *Cache) lookup(key string) (path string) {
+	el, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	e := el.Value.(*cacheEntry)
+	file := filepath.Join(c.root, key)
+	info, err := os.Stat(file)
+	if err != nil || info.Size() != e.Size {
+		log.Debugf("cache of %s is broken", key)
+		c.remove(el)
+		c.save()
+		return
+	}
+	e.Used = time.Now().UnixNano()
+	c.lru.MoveToFront(el)
+	c.dirty = true
+	if time.Since(c.saved) >= CacheIndexFlushInterval {
+		c.save()
+	}
+	path = file
+	return
+}
+
+// add links file into the cache as key, and evicts the least recently used
+// entries over the size limit
+func (c *Cache) add(key string, file string) (err error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		err = errors.Wrap(err, "add to cache error")
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	err = os.Link(file, filepath.Join(c.root, key))
+	if err != nil {
+		err = errors.Wrap(err, "add to cache error")
+		return
+	}
+	e := &cacheEntry{Key: key, Size: info.Size(), Used: time.Now().UnixNano()}
+	c.entries[key] = c.lru.PushFront(e)
+	c.size += e.Size
+	c.evict(key)
+	err = c.save()
+	if err != nil {
+		err = errors.Wrap(err, "add to cache error")
+		return
+	}
+	return
+}
+
+// evict removes the least recently used entries until the cache fits, but
+// keeps the entry of key
+func (c *Cache) evict(keep string) {
+	if c.max <= 0 {
+		return
+	}
+	for el := c.lru.Back(); el != nil && c.size > c.max; {
+		prev := el.Prev()
+		if e := el.Value.(*cacheEntry); e.Key != keep {
+			log.Debugf("evict %s (%d bytes) from cache", e.Key, e.Size)
+			c.remove(el)
+		}
+		el = prev
+	}
+}
+
+// remove removes the entry and its file
+func (c *Cache) remove(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, e.Key)
+	c.size -= e.Size
+	err := os.Remove(filepath.Join(c.root, e.Key))
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("remove %s from cache error: %s", e.Key, err)
+	}
+}
+
+// save writes the index, the most recently used first
+func (c *Cache) save() (err error) {
+	index := []*cacheEntry{}
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		index = append(index, el.Value.(*cacheEntry))
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		err = errors.Wrap(err, "save cache index error")
+		return
+	}
+	tmp := filepath.Join(c.root, fmt.Sprintf(".%s.%d", CacheIndex, os.Getpid()))
+	err = ioutil.WriteFile(tmp, data, FilePerm)
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(c.root, CacheIndex))
+	}
+	if err != nil {
+		err = errors.Wrap(err, "save cache index error")
+		return
+	}
+	c.dirty = false
+	c.saved = time.Now()
+	return
+}
+
+// Flush saves the index if the last uses of the hits are not saved yet
+func (c *Cache) Flush() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return
+	}
+	err = c.save()
+	return
+}
+
+// Size returns the total size of the entries
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
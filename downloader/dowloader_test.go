@@ -2,9 +2,20 @@ package downloader
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/VOID001/D-judge/config"
@@ -33,8 +44,7 @@ func TestDoWithoutCache(t *testing.T) {
 	d.FileName = "testdata"
 	d.SkipMD5Check = true
 	d.UseCache = false
-	d.FileType = "code"
-	d.Params = []string{"1"}
+	d.URL = "/executable?execid=c"
 	err := d.Do(context.Background())
 	if err != nil {
 		t.Logf("downloader do error: %+v", err)
@@ -56,9 +66,8 @@ func TestDoWithCache(t *testing.T) {
 	d.FileName = "testdata"
 	d.SkipMD5Check = false
 	d.UseCache = true
-	d.FileType = "code"
-	d.Params = []string{"1"}
-	d.MD5 = "f7af11c0363fafa66f1705058f1a0058"
+	d.URL = "/executable?execid=c"
+	d.MD5 = "c76e6afa913a9fc827c42c2357f47a53"
 	err := d.Do(context.Background())
 	if err != nil {
 		t.Logf("downloader do error: %+v", err)
@@ -70,7 +79,7 @@ func TestDoWithCache(t *testing.T) {
 		t.Fail()
 		return
 	}
-	if _, err := os.Stat(filepath.Join(config.GlobalConfig.CacheRoot, d.FileName)); err != nil && os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(config.GlobalConfig.CacheRoot, HashMD5, d.MD5)); err != nil && os.IsNotExist(err) {
 		t.Logf("download failed but downloader do not return error")
 		t.Fail()
 		return
@@ -84,8 +93,7 @@ func TestDownExecutableWithCache(t *testing.T) {
 	d.FileName = "c.zip"
 	d.SkipMD5Check = false
 	d.UseCache = true
-	d.FileType = "executable"
-	d.Params = []string{"c"}
+	d.URL = "/executable?execid=c"
 	d.MD5 = "c76e6afa913a9fc827c42c2357f47a53"
 	err := d.Do(context.Background())
 	if err != nil {
@@ -99,7 +107,7 @@ func TestDownExecutableWithCache(t *testing.T) {
 		t.Fail()
 		return
 	}
-	if _, err := os.Stat(filepath.Join(config.GlobalConfig.CacheRoot, d.FileName)); err != nil && os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(config.GlobalConfig.CacheRoot, HashMD5, d.MD5)); err != nil && os.IsNotExist(err) {
 		t.Logf("download failed but downloader do not return error")
 		t.Fail()
 		return
@@ -113,8 +121,7 @@ func TestDownTestcaseWithCache(t *testing.T) {
 	d.FileName = "test.in"
 	d.SkipMD5Check = false
 	d.UseCache = true
-	d.FileType = "testcase"
-	d.Params = []string{"2", "input"}
+	d.URL = "/testcase_files?testcaseid=2&input"
 	d.MD5 = "f303b7d2f2b87f9e16df05e2bca7c409"
 	err := d.Do(context.Background())
 	if err != nil {
@@ -128,10 +135,259 @@ func TestDownTestcaseWithCache(t *testing.T) {
 		t.Fail()
 		return
 	}
-	if _, err := os.Stat(filepath.Join(config.GlobalConfig.CacheRoot, d.FileName)); err != nil && os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(config.GlobalConfig.CacheRoot, HashMD5, d.MD5)); err != nil && os.IsNotExist(err) {
 		t.Logf("download failed but downloader do not return error")
 		t.Fail()
 		return
 	}
 	return
 }
+
+func TestCacheEvict(t *testing.T) {
+	root, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	c, err := OpenCache(filepath.Join(root, "cache"), 10)
+	if err != nil {
+		t.Logf("open cache error: %+v", err)
+		t.Fail()
+		return
+	}
+	sum := func(data string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(data)))
+	}
+	fetch := func(data string) {
+		dest := filepath.Join(root, fmt.Sprintf("%s-%d", data, time.Now().UnixNano()))
+		err := c.Fetch(context.Background(), HashMD5, sum(data), dest, func(dest string) error {
+			return ioutil.WriteFile(dest, []byte(data), FilePerm)
+		})
+		if err != nil {
+			t.Logf("fetch %s error: %+v", data, err)
+			t.Fail()
+		}
+	}
+	fetch("aaaa")
+	fetch("bbbb")
+	fetch("aaaa") // a is used after b now
+	fetch("cccc")
+	if c.Size() != 8 {
+		t.Logf("expected 8 bytes cached, got %d", c.Size())
+		t.Fail()
+	}
+	if _, err := os.Stat(filepath.Join(root, "cache", HashMD5, sum("bbbb"))); !os.IsNotExist(err) {
+		t.Logf("expected b evicted, got %+v", err)
+		t.Fail()
+	}
+
+	// The index is read on startup
+	c, err = OpenCache(filepath.Join(root, "cache"), 10)
+	if err != nil {
+		t.Logf("open cache error: %+v", err)
+		t.Fail()
+		return
+	}
+	if c.Size() != 8 || c.lookup(HashMD5+"/"+sum("aaaa")) == "" || c.lookup(HashMD5+"/"+sum("cccc")) == "" {
+		t.Logf("expected a and c cached after reopen, size %d", c.Size())
+		t.Fail()
+	}
+}
+
+func TestCacheLazyIndex(t *testing.T) {
+	root, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	c, err := OpenCache(filepath.Join(root, "cache"), 0)
+	if err != nil {
+		t.Logf("open cache error: %+v", err)
+		t.Fail()
+		return
+	}
+	index := filepath.Join(root, "cache", CacheIndex)
+	sum := fmt.Sprintf("%x", md5.Sum([]byte("data")))
+	fetch := func() {
+		dest := filepath.Join(root, fmt.Sprintf("dest-%d", time.Now().UnixNano()))
+		err := c.Fetch(context.Background(), HashMD5, sum, dest, func(dest string) error {
+			return ioutil.WriteFile(dest, []byte("data"), FilePerm)
+		})
+		if err != nil {
+			t.Logf("fetch error: %+v", err)
+			t.Fail()
+		}
+	}
+	fetch()
+	added, _ := ioutil.ReadFile(index)
+
+	// A hit is not saved right away
+	fetch()
+	if data, _ := ioutil.ReadFile(index); string(data) != string(added) || !c.dirty {
+		t.Logf("expected the index not saved on a hit, got %s", data)
+		t.Fail()
+	}
+	err = c.Flush()
+	if data, _ := ioutil.ReadFile(index); err != nil || string(data) == string(added) || c.dirty {
+		t.Logf("expected the index saved on flush, got %s error %+v", data, err)
+		t.Fail()
+	}
+
+	// Or once a while
+	fetch()
+	c.saved = c.saved.Add(-CacheIndexFlushInterval)
+	flushed, _ := ioutil.ReadFile(index)
+	fetch()
+	if data, _ := ioutil.ReadFile(index); string(data) == string(flushed) || c.dirty {
+		t.Logf("expected the index saved after %s, got %s", CacheIndexFlushInterval, data)
+		t.Fail()
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	cases := []struct {
+		algo string
+		sum  string
+		ok   bool
+	}{
+		{HashMD5, "c76e6afa913a9fc827c42c2357f47a53", true},
+		{HashMD5, "C76E6AFA913A9FC827C42C2357F47A53", true},
+		{HashSHA256, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", true},
+		{HashSHA256, "c76e6afa913a9fc827c42c2357f47a53", false},
+		{HashMD5, "../../../../etc/passwd/aaaaaaaaa", false},
+		{"sha1", "da39a3ee5e6b4b0d3255bfef95601890afd80709", false},
+	}
+	for _, cs := range cases {
+		_, err := cacheKey(cs.algo, cs.sum)
+		if (err == nil) != cs.ok {
+			t.Logf("key of %s %s expected ok %v, got %+v", cs.algo, cs.sum, cs.ok, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestCacheMigrate(t *testing.T) {
+	root, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sum := fmt.Sprintf("%x", md5.Sum([]byte("data")))
+	os.MkdirAll(filepath.Join(root, "1-old.in"), DirPerm)
+	ioutil.WriteFile(filepath.Join(root, "1-old.in", CacheContent), []byte("data"), FilePerm)
+	ioutil.WriteFile(filepath.Join(root, "1-old.in", CacheChecksum), []byte(sum), FilePerm)
+	c, err := OpenCache(root, 0)
+	if err != nil {
+		t.Logf("open cache error: %+v", err)
+		t.Fail()
+		return
+	}
+	if c.lookup(HashMD5+"/"+sum) == "" || c.Size() != 4 {
+		t.Logf("expected the old entry moved to its checksum")
+		t.Fail()
+	}
+	if _, err := os.Stat(filepath.Join(root, "1-old.in")); !os.IsNotExist(err) {
+		t.Logf("expected the old entry removed, got %+v", err)
+		t.Fail()
+	}
+}
+
+func TestCacheFetchOnce(t *testing.T) {
+	root, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	c, err := OpenCache(filepath.Join(root, "cache"), 0)
+	if err != nil {
+		t.Logf("open cache error: %+v", err)
+		t.Fail()
+		return
+	}
+	sum := fmt.Sprintf("%x", md5.Sum([]byte("data")))
+	var downloads int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dest := filepath.Join(root, fmt.Sprintf("dest%d", i))
+			err := c.Fetch(context.Background(), HashMD5, sum, dest, func(dest string) error {
+				atomic.AddInt32(&downloads, 1)
+				time.Sleep(10 * time.Millisecond)
+				return ioutil.WriteFile(dest, []byte("data"), FilePerm)
+			})
+			if err != nil {
+				t.Logf("fetch error: %+v", err)
+				t.Fail()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if downloads != 1 {
+		t.Logf("expected one download, got %d", downloads)
+		t.Fail()
+	}
+}
+
+func TestDownloadStream(t *testing.T) {
+	data := strings.Repeat("testcase data with some bytes/+\n", 100)
+	b64 := base64.StdEncoding.EncodeToString([]byte(data))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/raw":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			io.WriteString(w, data)
+		case "/json":
+			// PHP escapes the slashes
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, ` "`+strings.Replace(b64, "/", `\/`, -1)+`"`)
+		case "/broken":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `"`+b64[:100])
+		}
+	}))
+	defer srv.Close()
+	old := config.GlobalConfig.EndpointURL
+	config.GlobalConfig.EndpointURL = srv.URL
+	defer func() { config.GlobalConfig.EndpointURL = old }()
+
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sum := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+	cases := []struct {
+		url string
+		md5 string
+		max int64
+		ok  bool
+	}{
+		{"/raw", sum, 0, true},
+		{"/json", sum, 0, true},
+		{"/raw", sum, int64(len(data)), true},
+		{"/raw", sum, int64(len(data)) - 1, false},
+		{"/json", sum, int64(len(data)) - 1, false},
+		{"/raw", fmt.Sprintf("%x", md5.Sum(nil)), 0, false},
+		{"/broken", sum, 0, false},
+	}
+	for i, cs := range cases {
+		d := Downloader{URL: cs.url, FileName: cs.url, MD5: cs.md5, MaxSize: cs.max, Destination: filepath.Join(dir, fmt.Sprintf("file%d", i))}
+		err := d.Do(context.Background())
+		if (err == nil) != cs.ok {
+			t.Logf("download %s limit %d expected ok %v, got %+v", cs.url, cs.max, cs.ok, err)
+			t.Fail()
+			continue
+		}
+		got, er := ioutil.ReadFile(d.Destination)
+		if cs.ok && string(got) != data {
+			t.Logf("download %s expected the data, got %d bytes %+v", cs.url, len(got), er)
+			t.Fail()
+		}
+		if !cs.ok && !os.IsNotExist(er) {
+			t.Logf("download %s expected no file left, got %+v", cs.url, er)
+			t.Fail()
+		}
+	}
+}
@@ -1,182 +1,246 @@
 package downloader
 
 import (
+	"bufio"
 	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"io/ioutil"
-	"net/http"
+	"io"
 	"os"
-	"path/filepath"
+	"strings"
 
 	"github.com/VOID001/D-judge/config"
 	"github.com/VOID001/D-judge/request"
 	"github.com/pkg/errors"
 )
 
-var apiMap = map[string]string{
-	"testcase":   "/testcase_files?testcaseid=%s&%%s", // Seems strange but works!
-	"executable": "/executable?execid=%s",
-	"code":       "/submission_files?id=%s",
-}
-
+// Downloader fetch a base64 encoded file from the judge server, the URL is
+// relative to the endpoint and provided by the judge server backend. The
+// file is cached by SHA256 if given, or MD5, FileName is only for logs
 type Downloader struct {
-	FileType     string
+	URL          string
 	FileName     string
 	MD5          string
+	SHA256       string
 	Destination  string
 	UseCache     bool
-	Params       []string
-	SkipMD5Check bool
+	SkipMD5Check bool  // Skips all checksums, the file is not cached then
+	MaxSize      int64 // In bytes, max_download_size if 0
 }
 
 const (
-	DirPerm       = 0755
-	FilePerm      = 0644
+	DirPerm  = 0755
+	FilePerm = 0644
+	// The cache layout of older versions, <name>/content and <name>/checksum
 	CacheContent  = "content"
 	CacheChecksum = "checksum"
+	// The progress of a download is logged every this many bytes
+	DownloadProgress = 64 << 20
 )
 
-func cleanupcache() (err error) {
-	err = os.RemoveAll(config.GlobalConfig.CacheRoot)
-	if err != nil {
-		err = errors.Wrap(err, "error clean up cache")
-		return
+// checksum returns the algorithm and sum the file is cached by
+func (d *Downloader) checksum() (algo string, sum string) {
+	if d.SHA256 != "" {
+		return HashSHA256, d.SHA256
 	}
-	err = os.Mkdir(config.GlobalConfig.CacheRoot, DirPerm)
-	if err != nil {
-		err = errors.Wrap(err, "error clean up cache")
-		return
-	}
-	return
+	return HashMD5, d.MD5
 }
 
 func (d *Downloader) Do(ctx context.Context) (err error) {
-	var content string
-	url := apiMap[d.FileType]
-	for i := 0; i < len(d.Params); i++ {
-		url = fmt.Sprintf(url, d.Params[i])
-		log.Debugf("url = %s", url)
+	log.Debugf("url = %s", d.URL)
+	// A file without checksum can not be found in the cache
+	algo, sum := d.checksum()
+	if d.UseCache && sum != "" && !d.SkipMD5Check {
+		// Errors opening the cache are not fatal, just fallback to no cache mode
+		c, er := defaultCache()
+		if er == nil {
+			err = c.Fetch(ctx, algo, sum, d.Destination, func(dest string) error { return d.download(ctx, dest) })
+			if err != nil {
+				err = errors.Wrap(err, "error processing download")
+			}
+			return
+		}
+		log.Error(errors.Wrap(er, fmt.Sprintf("error processing download, downloader info %+v", d)))
+		log.Infof("Fall back to no cache mode")
 	}
+	err = d.download(ctx, d.Destination)
+	return
+}
 
-	hit := d.UseCache
-	if d.UseCache {
-		// All errors when lookup cache is not fatal, just fallback to no cache mode
-		path, er := lookupcache(d.FileName, d.MD5)
-		if er != nil {
-			err = errors.Wrap(er, fmt.Sprintf("error processing download, downloader info %+v", d))
-			log.Error(err)
-			log.Infof("Fall back to no cache mode")
-			hit = false
-		}
+// download streams the file into dest, hashing it on the fly. The endpoint
+// either sends the file as it is, or as a base64 JSON string (with a JSON
+// content type), which is decoded on the fly too. dest is only there when
+// the download is complete and checked
+func (d *Downloader) download(ctx context.Context, dest string) (err error) {
+	if !d.SkipMD5Check && d.MD5 == "" && d.SHA256 == "" {
+		err = errors.New("error processing download: no checksum to check")
+		return
+	}
+	max := d.MaxSize
+	if max <= 0 {
+		max = config.GlobalConfig.MaxDownloadSize
+	}
+	resp, err := request.Open(ctx, d.URL)
+	if err != nil {
+		err = errors.Wrap(err, "error processing download")
+		return
+	}
+	defer resp.Body.Close()
 
-		// Cached data found, return now
-		if hit && path != "" {
-			os.Link(path, d.Destination)
-			return
-		}
+	var body io.Reader = resp.Body
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), request.TypeJSON) {
+		body = base64.NewDecoder(base64.StdEncoding, newJSONString(resp.Body))
+	} else if max > 0 && resp.ContentLength > max {
+		err = errors.New(fmt.Sprintf("error processing download: file of %d bytes exceeds the limit of %d bytes", resp.ContentLength, max))
+		return
+	}
+	if max > 0 {
+		// One more byte to tell a file just as large as the limit
+		body = io.LimitReader(body, max+1)
 	}
 
-	switch d.FileType {
-	case "code":
-		// Provide the code name
-		m := []map[string]string{}
-		err = request.Do(ctx, http.MethodGet, url, nil, "", &m)
-		if err != nil {
-			err = errors.Wrap(err, "error processing download")
-			return
-		}
-		content = m[0]["content"]
-		d.Destination = filepath.Join(filepath.Dir(d.Destination), m[0]["filename"])
-		d.FileName = m[0]["filename"]
-		break
-	default:
-		err = request.Do(ctx, http.MethodGet, url, nil, "", &content)
+	part := dest + ".part"
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FilePerm)
+	if err != nil {
+		err = errors.Wrap(err, "error processing download")
+		return
+	}
+	defer func() {
 		if err != nil {
-			err = errors.Wrap(err, "error processing download")
-			return
+			os.Remove(part)
 		}
-		break
+	}()
+	md5sum := md5.New()
+	sha256sum := sha256.New()
+	progress := &progressWriter{name: d.FileName, total: resp.ContentLength}
+	n, err := io.Copy(io.MultiWriter(f, md5sum, sha256sum, progress), body)
+	er := f.Close()
+	if err == nil {
+		err = er
 	}
-
-	// Decode the base64 data
-	data, er := base64.StdEncoding.DecodeString(content)
-	if er != nil {
-		er = errors.Wrap(er, "error processing download")
+	if err != nil {
+		err = errors.Wrap(err, "error processing download")
+		return
+	}
+	if max > 0 && n > max {
+		err = errors.New(fmt.Sprintf("error processing download: file exceeds the limit of %d bytes", max))
+		return
 	}
-	// Check MD5
+	log.Debugf("downloaded %s, %d bytes", d.FileName, n)
+
+	// Check MD5, and SHA256 if given
 	if !d.SkipMD5Check {
-		checksum := md5.Sum(data)
-		log.Debugf("checksum = %x, d.MD5 = %s", checksum, d.MD5)
-		if fmt.Sprintf("%x", checksum) != d.MD5 {
+		checksum := fmt.Sprintf("%x", md5sum.Sum(nil))
+		log.Debugf("checksum = %s, d.MD5 = %s", checksum, d.MD5)
+		if d.MD5 != "" && !strings.EqualFold(checksum, d.MD5) {
 			err = errors.New("error processing download: checksum error, file corrupted during download")
 			return
 		}
+		if d.SHA256 != "" && !strings.EqualFold(fmt.Sprintf("%x", sha256sum.Sum(nil)), d.SHA256) {
+			err = errors.New("error processing download: sha256 checksum error, file corrupted during download")
+			return
+		}
 	}
 
 	if d.SkipMD5Check {
 		log.Debugf("MD5 checksum skipped")
 	}
 
-	err = ioutil.WriteFile(d.Destination, data, FilePerm)
+	err = os.Rename(part, dest)
 	if err != nil {
 		err = errors.Wrap(err, "error processing download")
 	}
+	return
+}
 
-	// Save cache errors is not fatal
-	if d.UseCache && !hit {
-		log.Debugf("Cache not hit")
-		os.Mkdir(filepath.Join(config.GlobalConfig.CacheRoot, d.FileName), DirPerm)
-		cachedata := filepath.Join(config.GlobalConfig.CacheRoot, d.FileName, CacheContent)
-		err = os.Link(d.Destination, cachedata)
-		if err != nil {
-			log.Errorf("save into cache failed, error %+v", err)
-		}
-		cachemd5 := filepath.Join(config.GlobalConfig.CacheRoot, d.FileName, CacheChecksum)
-		err = ioutil.WriteFile(cachemd5, []byte(d.MD5), FilePerm)
-		if err != nil {
-			log.Errorf("save into cache failed, error %+v", err)
+// progressWriter logs the progress of a download every DownloadProgress bytes
+type progressWriter struct {
+	name  string
+	total int64 // -1 if unknown
+	n     int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	before := p.n / DownloadProgress
+	p.n += int64(len(b))
+	if p.n/DownloadProgress != before {
+		if p.total > 0 {
+			log.Infof("downloading %s, %d of %d bytes", p.name, p.n, p.total)
+		} else {
+			log.Infof("downloading %s, %d bytes", p.name, p.n)
 		}
-		err = nil
 	}
-	return
+	return len(b), nil
 }
 
-func lookupcache(name string, md5sum string) (path string, err error) {
-	log.Debugf("lookupcache(name = %s, md5sum = %s)", name, md5sum)
-	look := filepath.Join(config.GlobalConfig.CacheRoot, name)
-	info, er := os.Stat(look)
-	if er != nil {
-		err = errors.Wrap(er, "error lookup cache")
-		return
-	}
+// jsonString reads the content of a JSON string, the body of an endpoint
+// sending a base64 file. The base64 alphabet only needs \/ unescaped, the
+// escaped line breaks are kept for the base64 decoder to skip
+type jsonString struct {
+	r       *bufio.Reader
+	started bool
+	done    bool
+}
+
+func newJSONString(r io.Reader) *jsonString {
+	return &jsonString{r: bufio.NewReader(r)}
+}
 
-	// Cache Should be a directory
-	if !info.IsDir() {
-		err = errors.New("error lookup cache: path is not a dir")
+func (j *jsonString) Read(p []byte) (n int, err error) {
+	if !j.started {
+		c, er := j.skipSpace()
+		if er != nil {
+			return 0, errors.Wrap(er, "read JSON string error")
+		}
+		if c != '"' {
+			return 0, errors.New(fmt.Sprintf("read JSON string error: unexpected %q", c))
+		}
+		j.started = true
 	}
-	look = filepath.Join(look, "content")
-	file, er := os.Open(look)
-	if er != nil {
-		err = errors.Wrap(er, "error lookup cache")
-		return
+	for n < len(p) && !j.done {
+		c, er := j.r.ReadByte()
+		if er == io.EOF {
+			return n, errors.New("read JSON string error: unexpected end")
+		}
+		if er != nil {
+			return n, er
+		}
+		switch c {
+		case '"':
+			j.done = true
+			continue
+		case '\\':
+			c, er = j.r.ReadByte()
+			if er != nil {
+				return n, errors.New("read JSON string error: unexpected end")
+			}
+			switch c {
+			case '/':
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			default:
+				return n, errors.New(fmt.Sprintf("read JSON string error: unexpected escape \\%c", c))
+			}
+		}
+		p[n] = c
+		n++
 	}
-	defer file.Close()
-
-	oldfile, er := ioutil.ReadFile(look)
-
-	if er != nil {
-		err = errors.Wrap(er, "error lookup cache")
-		return
+	if j.done && n == 0 {
+		err = io.EOF
 	}
-	oldmd5 := md5.Sum(oldfile)
+	return
+}
 
-	if fmt.Sprintf("%x", oldmd5) != md5sum {
-		err = errors.New("error lookup cache, md5sum do not match")
-		return
+func (j *jsonString) skipSpace() (c byte, err error) {
+	for {
+		c, err = j.r.ReadByte()
+		if err != nil || (c != ' ' && c != '\t' && c != '\n' && c != '\r') {
+			return
+		}
 	}
-	path = filepath.Join(config.GlobalConfig.CacheRoot, name, CacheContent)
-	return
 }
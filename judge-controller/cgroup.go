@@ -0,0 +1,422 @@
+package controller
+
+// Read the resource usage of the judging container from its cgroup, both
+// cgroup v1 and the unified hierarchy (cgroup v2) are supported. A run is
+// measured in a fresh child cgroup of the container, so its usage is not
+// mixed with the compile, the compare or the earlier judgings of a warm
+// container, and no peak needs to be reset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	CgroupRoot = "/sys/fs/cgroup"
+	// On cgroup v2 a cgroup with children using the memory controller can
+	// not have processes, so the init and everything exec'd in the
+	// container are moved to CgroupInit. docker exec (runc) joins the
+	// cgroup of the init when the container cgroup is not a leaf
+	CgroupInit = "djudge-init"
+	// CgroupRun is the child cgroup a run is measured in
+	CgroupRun = "djudge-run"
+)
+
+type cgroup struct {
+	init    int // Pid of the container init process, 0 for a run cgroup
+	v2      bool
+	memory  string // Directory of the memory controller, the unified directory for v2
+	cpuacct string // Directory of the cpuacct controller, the unified directory for v2
+	// peak tells whether the peak memory is kept by the kernel, memory.peak
+	// of v2 is there since linux 5.19. Otherwise memory.current is sampled
+	// into sampled
+	peak    bool
+	sampled uint64
+}
+
+// openCgroup finds the cgroup of the process pid, usually the init process of the container
+func openCgroup(pid int) (cg *cgroup, err error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		err = errors.Wrap(err, "open cgroup error")
+		return
+	}
+	defer f.Close()
+
+	cg, err = parseCgroup(f)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("open cgroup error: pid %d", pid))
+		return
+	}
+	cg.init = pid
+	if cg.v2 {
+		err = cg.split()
+		if err != nil {
+			err = errors.Wrap(err, "open cgroup error")
+			return
+		}
+	}
+	return
+}
+
+// parseCgroup parses /proc/<pid>/cgroup, the cgroup of a container split
+// already is the parent of CgroupInit
+func parseCgroup(r io.Reader) (cg *cgroup, err error) {
+	cg = &cgroup{}
+	unified := ""
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(sc.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		path := strings.TrimSuffix(fields[2], "/"+CgroupInit)
+		if fields[0] == "0" && fields[1] == "" {
+			unified = path
+		}
+		// Controllers may be co-mounted, like cpu,cpuacct
+		for _, c := range strings.Split(fields[1], ",") {
+			switch c {
+			case "memory":
+				cg.memory = filepath.Join(CgroupRoot, fields[1], path)
+			case "cpuacct":
+				cg.cpuacct = filepath.Join(CgroupRoot, fields[1], path)
+			}
+		}
+	}
+	if cg.memory == "" && cg.cpuacct == "" && unified != "" {
+		cg.v2 = true
+		cg.memory = filepath.Join(CgroupRoot, unified)
+		cg.cpuacct = cg.memory
+	}
+	if cg.memory == "" || cg.cpuacct == "" {
+		err = errors.New("no memory or cpuacct cgroup")
+		return
+	}
+	cg.peak = !cg.v2 || exists(filepath.Join(cg.memory, "memory.peak"))
+	return
+}
+
+// split moves the processes of the container cgroup to CgroupInit and
+// enables the memory controller for the children (cgroup v2 only)
+func (cg *cgroup) split() (err error) {
+	init := filepath.Join(cg.memory, CgroupInit)
+	err = os.Mkdir(init, DirPerm)
+	if err != nil && !os.IsExist(err) {
+		err = errors.Wrap(err, "split cgroup error")
+		return
+	}
+	// An exec may be joining meanwhile, try again then
+	for i := 0; i < 10; i++ {
+		pids, er := readPids(filepath.Join(cg.memory, "cgroup.procs"))
+		if er != nil {
+			err = errors.Wrap(er, "split cgroup error")
+			return
+		}
+		for _, pid := range pids {
+			// The process may exit already
+			ioutil.WriteFile(filepath.Join(init, "cgroup.procs"), []byte(strconv.Itoa(pid)), FilePerm)
+		}
+		err = ioutil.WriteFile(filepath.Join(cg.memory, "cgroup.subtree_control"), []byte("+memory"), FilePerm)
+		if err == nil {
+			return
+		}
+	}
+	err = errors.Wrap(err, "split cgroup error")
+	return
+}
+
+// newRun creates the fresh cgroup a run is measured in, its memory is
+// limited to memlim bytes without swap, 0 for the limit of the container.
+// It should be removed when the run is done
+func (cg *cgroup) newRun(memlim int64) (run *cgroup, err error) {
+	run = &cgroup{v2: cg.v2, memory: filepath.Join(cg.memory, CgroupRun), cpuacct: filepath.Join(cg.cpuacct, CgroupRun)}
+	// Left by a crash
+	err = run.remove()
+	if err != nil {
+		err = errors.Wrap(err, "create run cgroup error")
+		return
+	}
+	for _, dir := range run.dirs() {
+		err = os.Mkdir(dir, DirPerm)
+		if err != nil {
+			err = errors.Wrap(err, "create run cgroup error")
+			return
+		}
+	}
+	run.peak = !run.v2 || exists(filepath.Join(run.memory, "memory.peak"))
+	if memlim <= 0 {
+		return
+	}
+	limit, swap, swaplim := "memory.limit_in_bytes", "memory.memsw.limit_in_bytes", strconv.FormatInt(memlim, 10)
+	if run.v2 {
+		limit, swap, swaplim = "memory.max", "memory.swap.max", "0"
+	}
+	err = ioutil.WriteFile(filepath.Join(run.memory, limit), []byte(strconv.FormatInt(memlim, 10)), FilePerm)
+	// Swap accounting may be off
+	if err == nil && exists(filepath.Join(run.memory, swap)) {
+		err = ioutil.WriteFile(filepath.Join(run.memory, swap), []byte(swaplim), FilePerm)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "create run cgroup error")
+		return
+	}
+	return
+}
+
+// dirs returns the directories of the cgroup, one for each controller
+func (cg *cgroup) dirs() []string {
+	if cg.memory == cg.cpuacct {
+		return []string{cg.memory}
+	}
+	return []string{cg.memory, cg.cpuacct}
+}
+
+// attach moves the process nspid, a pid in the pid namespace of the
+// container, into the run cgroup
+func (cg *cgroup) attach(container *cgroup, nspid int) (err error) {
+	pids, err := cgroupPids(container.memory)
+	if err != nil {
+		err = errors.Wrap(err, "attach to run cgroup error")
+		return
+	}
+	pid := 0
+	for _, p := range pids {
+		data, er := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", p))
+		if er == nil && innermostPid(string(data)) == nspid {
+			pid = p
+			break
+		}
+	}
+	if pid == 0 {
+		err = errors.New(fmt.Sprintf("attach to run cgroup error: pid %d not found in the container", nspid))
+		return
+	}
+	for _, dir := range cg.dirs() {
+		err = ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), FilePerm)
+		if err != nil {
+			err = errors.Wrap(err, "attach to run cgroup error")
+			return
+		}
+	}
+	return
+}
+
+// innermostPid returns the pid in the innermost pid namespace from the
+// NSpid line of /proc/<pid>/status, 0 if there is none
+func innermostPid(status string) (pid int) {
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == "NSpid:" {
+			pid, _ = strconv.Atoi(fields[len(fields)-1])
+			return
+		}
+	}
+	return
+}
+
+// remove kills the processes left in the run cgroup and removes it
+func (cg *cgroup) remove() (err error) {
+	for _, dir := range cg.dirs() {
+		if !exists(dir) {
+			continue
+		}
+		pids, _ := readPids(filepath.Join(dir, "cgroup.procs"))
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		// The cgroup can be removed once the killed processes are gone
+		err = removeCgroup(dir)
+		if err != nil {
+			err = errors.Wrap(err, "remove run cgroup error")
+			return
+		}
+	}
+	return
+}
+
+// removeCgroup removes the cgroup dir and its children, the processes in
+// them should be killed already
+func removeCgroup(dir string) (err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			err = removeCgroup(filepath.Join(dir, f.Name()))
+			if err != nil {
+				return
+			}
+		}
+	}
+	for i := 0; i < 100; i++ {
+		err = os.Remove(dir)
+		if err == nil || os.IsNotExist(err) {
+			err = nil
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return
+}
+
+// sample keeps the max memory.current when the kernel does not keep the peak
+func (cg *cgroup) sample() {
+	if cg.peak {
+		return
+	}
+	cur, err := readUint(filepath.Join(cg.memory, "memory.current"))
+	if err == nil && cur > cg.sampled {
+		cg.sampled = cur
+	}
+}
+
+// peakMemory returns the max memory usage of the cgroup in bytes
+func (cg *cgroup) peakMemory() (mem uint64, err error) {
+	if !cg.peak {
+		cg.sample()
+		mem = cg.sampled
+		return
+	}
+	file := "memory.max_usage_in_bytes"
+	if cg.v2 {
+		file = "memory.peak"
+	}
+	mem, err = readUint(filepath.Join(cg.memory, file))
+	if err != nil {
+		err = errors.Wrap(err, "read peak memory error")
+		return
+	}
+	return
+}
+
+// oomKills returns how many processes are killed by the OOM killer in the cgroup
+func (cg *cgroup) oomKills() (count uint64, err error) {
+	file := "memory.oom_control"
+	if cg.v2 {
+		file = "memory.events"
+	}
+	count, err = readKeyedValue(filepath.Join(cg.memory, file), "oom_kill")
+	if err != nil {
+		err = errors.Wrap(err, "read oom kill count error")
+		return
+	}
+	return
+}
+
+// cpuUsage returns the total CPU time used by the cgroup in nanoseconds
+func (cg *cgroup) cpuUsage() (ns uint64, err error) {
+	if cg.v2 {
+		ns, err = readKeyedValue(filepath.Join(cg.cpuacct, "cpu.stat"), "usage_usec")
+		if err != nil {
+			err = errors.Wrap(err, "read cpu usage error")
+			return
+		}
+		ns *= 1000
+		return
+	}
+	ns, err = readUint(filepath.Join(cg.cpuacct, "cpuacct.usage"))
+	if err != nil {
+		err = errors.Wrap(err, "read cpu usage error")
+		return
+	}
+	return
+}
+
+// killAll kills all processes in the cgroup and its children except the
+// container init process
+func (cg *cgroup) killAll() (err error) {
+	pids, err := cgroupPids(cg.memory)
+	if err != nil {
+		err = errors.Wrap(err, "kill cgroup processes error")
+		return
+	}
+	for _, pid := range pids {
+		if pid == cg.init {
+			continue
+		}
+		// The process may exit already
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+	return
+}
+
+// cgroupPids returns the processes in the cgroup dir and its children
+func cgroupPids(dir string) (pids []int, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			p, er := readPids(filepath.Join(path, "cgroup.procs"))
+			if er != nil && !os.IsNotExist(er) {
+				return er
+			}
+			pids = append(pids, p...)
+		}
+		return nil
+	})
+	return
+}
+
+// readPids reads a cgroup.procs file
+func readPids(path string) (pids []int, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Fields(string(data)) {
+		pid, er := strconv.Atoi(line)
+		if er == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return
+}
+
+// readUint reads a cgroup file of a single number
+func readUint(path string) (value uint64, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	value, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return
+}
+
+// readKeyedValue reads the value of key from a flat keyed cgroup file like memory.stat
+func readKeyedValue(path string, key string) (value uint64, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			value, err = strconv.ParseUint(fields[1], 10, 64)
+			return
+		}
+	}
+	err = errors.New(fmt.Sprintf("key %s not found in %s", key, path))
+	return
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
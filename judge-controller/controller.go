@@ -3,36 +3,49 @@ package controller
 import (
 	"context"
 	"fmt"
+	"math/rand"
+	"os"
 	"path/filepath"
+	"time"
 
-	"runtime"
 	"sync"
 
 	"github.com/VOID001/D-judge/config"
-	"github.com/VOID001/D-judge/downloader"
-	"github.com/VOID001/D-judge/request"
+	"github.com/VOID001/D-judge/judge-server"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/docker/engine-api/client"
 	"github.com/pkg/errors"
-	//"github.com/docker/engine-api/types"
-	//"github.com/docker/engine-api/types/container"
 	"net/http"
 )
 
-var mu sync.Mutex
-var cpuMap []bool
-var cpuCount int
-
 const (
 	ErrMaxWorkerExceed = "max worker exceed"
 )
 
+// Worker states in Daemon.WorkerState
+const (
+	WorkerIdle    = "idle"
+	WorkerJudging = "judging"
+)
+
+// FetchInterval is the max interval of requesting a judging when the judge
+// server has nothing to judge
+const FetchInterval = 2500 * time.Millisecond
+
 type Daemon struct {
-	MaxWorker     int
-	CurrentWorker int
-	WorkerState   []string
-	workerChan    chan Worker
+	Server        server.JudgeServer
+	Pools         []config.PoolConfig // Worker pools, one pool of MaxWorker workers on judge_cpus if empty
+	MaxWorker     int                 // Number of workers of all pools, set by Run
+	CurrentWorker int                 // Number of workers judging
+	WorkerState   []string            // State of each worker, like "judging s12-j34"
+	JournalDir    string              // Journal of the judgings in progress, empty to disable the journal
+	Sandbox       Sandbox             // Where the judgings run, shared by all workers
+	stateMu       sync.Mutex
+	pools         []*pool
+	containers    *containerPool // Warm containers, nil if warm_containers is not set
+	freed         chan struct{}  // Notified when a worker finishes a judging
+	wg            sync.WaitGroup
+	cancel        context.CancelFunc
 	resultChan    chan RunResult
 }
 
@@ -45,147 +58,258 @@ type RunResult struct {
 var httpcli http.Client
 
 func init() {
-	cpuCount = runtime.NumCPU()
-	cpuMap = make([]bool, cpuCount)
 	httpcli = http.Client{}
 }
 
-func Ping(ctx context.Context) (err error) {
-	cli, err := client.NewClient(config.GlobalConfig.DockerServer, config.GlobalConfig.DockerVersion, nil, nil)
-	if err != nil {
-		err = errors.Wrap(err, "create docker client error")
-		return err
-	}
-	_, err = cli.Info(ctx)
-	if err != nil {
-		err = errors.Wrap(err, "ping docker server error")
-		return err
+func (d *Daemon) newWorker(jinfo config.JudgeInfo, dir string, img string) (w Worker) {
+	w.JudgeInfo = jinfo
+	w.judgeServer = d.Server
+	w.WorkDir = dir
+	w.RunUser = config.GlobalConfig.RunUser
+	if w.RunUser == "" {
+		w.RunUser = DefaultRunUser
 	}
+	w.DockerImage = img
+	w.journalDir = d.JournalDir
+	w.rootMemory = config.GlobalConfig.RootMemory
+	w.pidsLimit = DefaultPidsLimit
+	w.sandbox = d.Sandbox
+	w.containers = d.containers
 	return
 }
 
 func (d *Daemon) AddTask(ctx context.Context, jinfo config.JudgeInfo, dir string, img string) (err error) {
 	log.Debugf("call AddTask(context, jinfo = %+v, dir = %+v, img = %+v)", jinfo, dir, img)
-	w := Worker{}
-	w.JudgeInfo = jinfo
-	w.WorkDir = dir
-	w.RunUser = "root"
-	w.DockerImage = img
-	d.workerChan <- w
+	d.enqueue(d.newWorker(jinfo, dir, img))
 	return
 }
 
-func (d *Daemon) Run(ctx context.Context) {
-	d.workerChan = make(chan Worker, 100)
-	for i := 0; i < d.MaxWorker; i++ {
-		go d.run(ctx, i)
+// enqueue queues the task to its pool
+func (d *Daemon) enqueue(w Worker) {
+	d.stateMu.Lock()
+	p := d.route(w.JudgeInfo)
+	p.queued++
+	d.stateMu.Unlock()
+	p.profile(&w)
+	log.Debugf("judging %d queued to pool %s", w.JudgeInfo.JudgingID, p.Name)
+	p.queue <- w
+}
+
+// Idle returns the number of judgings that can be fetched without waiting
+// for a worker, that is the free workers of the pools with the lowest
+// MinTimeLimit. Whatever its time limit a judging fits them, the free
+// workers of the other pools are only used by the judgings routed there
+func (d *Daemon) Idle() (idle int) {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	min := d.lowest()
+	for _, p := range d.pools {
+		if p.MinTimeLimit == min {
+			idle += p.free()
+		}
 	}
 	return
 }
 
-func (d *Daemon) run(ctx context.Context, cpuid int) {
-	for {
-		// Only Judge Error Will Processed here, other error will process
-		// in the worker function
+// setState records the state of worker id of pool p, busy tells whether it starts or finishes a judging
+func (d *Daemon) setState(p *pool, id int, state string, busy bool) {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	d.WorkerState[id] = state
+	if busy {
+		p.queued--
+		p.busy++
+		d.CurrentWorker++
+		return
+	}
+	p.busy--
+	d.CurrentWorker--
+	select {
+	case d.freed <- struct{}{}:
+	default:
+	}
+}
+
+// Healthy tells whether the judgehost can judge, that is the sandbox runtime
+// is reachable. err is why not
+func (d *Daemon) Healthy() (healthy bool, err error) {
+	return d.Sandbox.Healthy()
+}
 
-		if w, ok := <-d.workerChan; ok {
-			log.Infof("Started Judging RunID #%d, running on CPU %d", w.JudgeInfo.SubmitID, cpuid)
-			w.CPUID = cpuid
-			err := w.prepare(ctx)
+// Fetch requests judgings for the idle workers until ctx is done, no more
+// judgings than idle workers are taken so other judgehosts can have the rest.
+// Nothing is fetched while the judgehost is unhealthy, it is marked inactive
+// on the judge server meanwhile
+func (d *Daemon) Fetch(ctx context.Context, img string) {
+	active := true
+	for {
+		healthy, herr := d.Healthy()
+		if healthy != active {
+			if healthy {
+				log.Infof("judgehost is healthy again, fetching judgings")
+			} else {
+				log.Errorf("judgehost is unhealthy, stop fetching judgings: %s", herr)
+			}
+			err := d.Server.SetActive(ctx, healthy)
 			if err != nil {
-				log.Error(err)
-				request.JudgeError(ctx, err, w.JudgeInfo.JudgingID)
-				continue // Future will change to continue
+				log.Warn(errors.Wrap(err, "fetch error"))
 			}
-			log.Infof("RunID #%d prepare OK", w.JudgeInfo.SubmitID)
-			ok, err := w.build(ctx)
+			active = healthy
+		}
+		empty := !healthy
+		for healthy && d.Idle() > 0 {
+			// Not canceled by ctx, or the judging may be taken but lost
+			jinfo, ok, err := d.Server.FetchJudging(context.Background())
 			if err != nil {
-				w.cleanup(ctx)
-				log.Error(err)
-				request.JudgeError(ctx, err, w.JudgeInfo.JudgingID)
-				continue
+				log.Warn(err)
 			}
-			// Compile Error, stop the current test
-			if !ok {
-				w.cleanup(ctx)
+			if err != nil || !ok {
+				empty = true
+				break
+			}
+			log.Infof("Fetched Submission ID #%d", jinfo.SubmitID)
+			dir, err := workDir(jinfo)
+			if err != nil {
+				err = errors.Wrap(err, "fetch error")
+				log.Error(err)
+				d.Server.JudgeError(ctx, jinfo, err)
 				continue
 			}
-			log.Infof("RunID #%d compile OK", w.JudgeInfo.SubmitID)
-			for {
-				// Request for testcase
-				tinfo := config.TestcaseInfo{}
-
-				err = request.Do(ctx, http.MethodGet, fmt.Sprintf("/testcases?judgingid=%d", w.JudgeInfo.SubmitID), nil, "", &tinfo)
-				if err != nil {
-					request.JudgeError(ctx, err, w.JudgeInfo.JudgingID)
-					break
-					// Return Judge Error
-				}
-				if tinfo.TestcaseID == 0 {
-					break
-				}
-				log.Debugf("Testcase info %+v", tinfo)
-
-				dl := downloader.Downloader{}
-				dl.FileType = "testcase"
-				dl.Destination = filepath.Join(w.WorkDir, fmt.Sprintf("testcase%03d.in", tinfo.Rank))
-				dl.FileName = fmt.Sprintf("%d-%s.in", tinfo.TestcaseID, tinfo.MD5SumInput)
-				dl.SkipMD5Check = false
-				dl.MD5 = tinfo.MD5SumInput
-				dl.UseCache = true
-				dl.Params = []string{fmt.Sprintf("%d", tinfo.TestcaseID), "input"}
-				err = dl.Do(ctx)
-				if err != nil {
-					err = errors.Wrap(err, "worker error: downloading testcase error")
-					log.Error(err)
-					request.JudgeError(ctx, err, w.JudgeInfo.JudgingID)
-					break
-					// Return Judge Error
-				}
-
-				dl.Destination = filepath.Join(w.WorkDir, fmt.Sprintf("testcase%03d.out", tinfo.Rank))
-				dl.FileName = fmt.Sprintf("%d-%s.out", tinfo.TestcaseID, tinfo.MD5SumInput)
-				dl.MD5 = tinfo.MD5SumOutput
-				dl.Params = []string{fmt.Sprintf("%d", tinfo.TestcaseID), "output"}
-				err = dl.Do(ctx)
-				if err != nil {
-					err = errors.Wrap(err, "worker error: downloading testcase error")
-					log.Error(err)
-					request.JudgeError(ctx, err, w.JudgeInfo.JudgingID)
-					break
-				}
-
-				// Run testcase
-				ok, err = w.run(ctx, tinfo.Rank, tinfo.TestcaseID)
-				if err != nil {
-					w.cleanup(ctx)
-					err = errors.Wrap(err, "worker error")
-					log.Error(err)
-					request.JudgeError(ctx, err, w.JudgeInfo.JudgingID)
-					break
-				}
-				if !ok {
-					break
-				}
-				log.Infof("Run Testcase %d OK", tinfo.Rank)
-
-				// Judge testcase
-				err = w.judge(ctx, tinfo.Rank, tinfo.TestcaseID)
-				if err != nil {
-					w.cleanup(ctx)
-					err = errors.Wrap(err, "worker error")
-					log.Error(err)
-					request.JudgeError(ctx, err, w.JudgeInfo.JudgingID)
-					break
-				}
-				log.Infof("Judge Testcase %d OK", tinfo.Rank)
+			d.AddTask(ctx, jinfo, dir, img)
+		}
+		// Wait for a worker to be free, and for a while if the server has
+		// nothing to judge
+		var wait <-chan time.Time
+		if empty {
+			wait = time.After(time.Duration(rand.Int63n(int64(FetchInterval))))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.freed:
+		case <-wait:
+		}
+	}
+}
 
+// workDir creates the work dir of the judging, the stale one left by an
+// earlier judging of it is renamed
+func workDir(jinfo config.JudgeInfo) (dir string, err error) {
+	dir = fmt.Sprintf("%s/c%d-s%d-j%d", config.GlobalConfig.JudgeRoot, jinfo.ContestID, jinfo.SubmitID, jinfo.JudgingID)
+	if _, er := os.Stat(dir); er == nil {
+		oldWorkDir := fmt.Sprintf("%s-old-%d", dir, time.Now().Unix())
+		log.Infof("Found stale working directory, rename to %s", oldWorkDir)
+		err = os.Rename(dir, oldWorkDir)
+		if err != nil {
+			err = errors.Wrap(err, "create work dir error")
+			return
+		}
+	}
+	err = os.Mkdir(dir, DirPerm)
+	if err != nil {
+		err = errors.Wrap(err, "create work dir error")
+		return
+	}
+	return
+}
+
+// Judge runs the judging synchronously on cpuid, without starting the daemon
+func (d *Daemon) Judge(ctx context.Context, jinfo config.JudgeInfo, dir string, img string, cpuid int) {
+	log.Debugf("call Judge(context, jinfo = %+v, dir = %+v, img = %+v, cpuid = %d)", jinfo, dir, img, cpuid)
+	d.judge(ctx, d.newWorker(jinfo, dir, img), cpuid)
+	return
+}
+
+// Run starts the workers of all pools
+func (d *Daemon) Run(ctx context.Context) (err error) {
+	cfgs := d.Pools
+	if len(cfgs) == 0 {
+		cfgs = []config.PoolConfig{{Name: "default", Workers: d.MaxWorker, CPUs: config.GlobalConfig.JudgeCPUs}}
+	}
+	d.pools, err = newPools(cfgs)
+	if err != nil {
+		err = errors.Wrap(err, "run daemon error")
+		return
+	}
+	d.MaxWorker = 0
+	for _, p := range d.pools {
+		d.MaxWorker += p.Workers
+	}
+	d.freed = make(chan struct{}, 1)
+	d.WorkerState = make([]string, d.MaxWorker)
+	for i := range d.WorkerState {
+		d.WorkerState[i] = WorkerIdle
+	}
+	ctx, d.cancel = context.WithCancel(ctx)
+	if config.GlobalConfig.WarmContainers > 0 {
+		d.containers, err = newContainerPool(d.Sandbox, filepath.Join(config.GlobalConfig.JudgeRoot, "sandbox"), config.GlobalConfig.WarmContainers, config.GlobalConfig.ContainerMaxUses)
+		if err != nil {
+			err = errors.Wrap(err, "run daemon error")
+			return
+		}
+		for _, p := range d.pools {
+			w := d.newWorker(config.JudgeInfo{}, "", config.GlobalConfig.DockerImage)
+			p.profile(&w)
+			for _, cpu := range p.cpus.cores {
+				w.CPUID = cpu
+				go d.containers.warm(ctx, w.key())
 			}
-			err = w.cleanup(ctx)
+		}
+	}
+	for _, p := range d.pools {
+		log.Infof("pool %s: %d workers on cpu %v", p.Name, p.Workers, p.cpus.cores)
+		for i := 0; i < p.Workers; i++ {
+			d.wg.Add(1)
+			go d.run(ctx, p, p.slot+i)
+		}
+	}
+	return
+}
+
+// Drain stops taking new tasks and waits until the running and queued
+// judgings finish, AddTask must not be called any more. When ctx is done
+// before that, the judgings are canceled and their containers cleaned up,
+// they are left in the journal to be recovered on next start
+func (d *Daemon) Drain(ctx context.Context) (err error) {
+	for _, p := range d.pools {
+		close(p.queue)
+	}
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warnf("drain timeout, cancel the judgings in progress")
+		d.cancel()
+		<-done
+		err = errors.Wrap(ctx.Err(), "drain error")
+	}
+	if d.containers != nil {
+		d.containers.close(context.Background())
+	}
+	return
+}
+
+func (d *Daemon) run(ctx context.Context, p *pool, id int) {
+	defer d.wg.Done()
+	for {
+		if w, ok := <-p.queue; ok {
+			d.setState(p, id, fmt.Sprintf("%s s%d-j%d", WorkerJudging, w.JudgeInfo.SubmitID, w.JudgeInfo.JudgingID), true)
+			cpuid, err := p.cpus.Get()
 			if err != nil {
+				// Never happens as a pool has no more workers than cores
+				err = errors.Wrap(err, "worker error")
 				log.Error(err)
+				w.judgeServer.JudgeError(ctx, w.JudgeInfo, err)
+				d.setState(p, id, WorkerIdle, false)
 				continue
 			}
+			d.judge(ctx, w, cpuid)
+			p.cpus.Put(cpuid)
+			d.setState(p, id, WorkerIdle, false)
 		} else {
 			break
 		}
@@ -193,16 +317,161 @@ func (d *Daemon) run(ctx context.Context, cpuid int) {
 	return
 }
 
-func GetAvailableCPU(ctx context.Context) (cpuid int, err error) {
-	for i := 0; i < cpuCount; i++ {
-		if cpuMap[i] != true {
-			mu.Lock()
-			cpuMap[i] = true
-			cpuid = i
-			defer mu.Unlock()
+func (d *Daemon) judge(ctx context.Context, w Worker, cpuid int) {
+	// Only Judge Error Will Processed here, other error will process
+	// in the worker function
+	log.Infof("Started Judging RunID #%d, running on CPU %d", w.JudgeInfo.SubmitID, cpuid)
+	w.CPUID = cpuid
+	w.saveJournal(StatePrepare)
+	defer func() {
+		// A canceled judging is unfinished, give it back and keep it for
+		// recovery, in case the server can not take it back
+		if ctx.Err() != nil {
+			err := w.judgeServer.GiveBack(context.Background(), w.JudgeInfo)
+			if err != nil {
+				log.Error(err)
+			}
 			return
 		}
+		w.removeJournal()
+	}()
+	err := w.prepare(ctx)
+	if err != nil {
+		log.Error(err)
+		w.judgeError(ctx, err)
+		return
+	}
+	log.Infof("RunID #%d prepare OK", w.JudgeInfo.SubmitID)
+	// Download the testcases while building
+	w.startPrefetch(ctx)
+	defer w.stopPrefetch()
+	ok, err := w.build(ctx)
+	if err != nil {
+		w.cleanup(ctx)
+		log.Error(err)
+		w.judgeError(ctx, err)
+		return
+	}
+	// Compile Error, stop the current test
+	if !ok {
+		w.cleanup(ctx)
+		return
+	}
+	log.Infof("RunID #%d compile OK", w.JudgeInfo.SubmitID)
+	w.saveJournal(StateRun)
+	sc, err := newScorer(w.JudgeInfo.Scoring)
+	if err != nil {
+		w.cleanup(ctx)
+		log.Error(err)
+		w.judgeError(ctx, err)
+		return
+	}
+	finished := false
+	for {
+		// Request for testcase
+		tinfo, ok, err := w.judgeServer.FetchTestcase(ctx, w.JudgeInfo)
+		if err != nil {
+			err = errors.Wrap(&server.ServerError{Err: err}, "worker error")
+			log.Error(err)
+			w.judgeError(ctx, err)
+			break
+			// Return Judge Error
+		}
+		if !ok {
+			finished = true
+			break
+		}
+		log.Debugf("Testcase info %+v", tinfo)
+
+		// The group scores nothing already, the server still wants a result
+		if skip, verdict, failed := sc.skip(tinfo); skip {
+			res := config.RunResult{
+				JudgingID:    w.JudgeInfo.JudgingID,
+				TestcaseID:   tinfo.TestcaseID,
+				JudgeTaskID:  tinfo.JudgeTaskID,
+				RunResult:    verdict,
+				OutputSystem: fmt.Sprintf("Skipped, testcase %d of the group failed.\n", failed),
+			}
+			sc.add(tinfo, res, 0)
+			err = w.judgeServer.PostRun(ctx, w.JudgeInfo, res)
+			if err != nil {
+				err = errors.Wrap(&server.ServerError{Err: err}, "worker error")
+				log.Error(err)
+				w.judgeError(ctx, err)
+				break
+			}
+			w.rank = tinfo.Rank
+			w.saveJournal(StateRun)
+			log.Infof("Skip Testcase %d", tinfo.Rank)
+			continue
+		}
+
+		err = w.fetchTestcase(ctx, tinfo)
+		if err != nil {
+			err = errors.Wrap(err, "worker error: downloading testcase error")
+			log.Error(err)
+			w.judgeError(ctx, err)
+			break
+			// Return Judge Error
+		}
+
+		// Run testcase
+		res, ok, err := w.run(ctx, tinfo)
+		if err != nil {
+			w.cleanup(ctx)
+			err = errors.Wrap(err, "worker error")
+			log.Error(err)
+			w.judgeError(ctx, err)
+			break
+		}
+		log.Infof("Run Testcase %d OK", tinfo.Rank)
+
+		// Judge testcase
+		if ok {
+			res, err = w.judge(ctx, tinfo, res)
+			if err != nil {
+				w.cleanup(ctx)
+				err = errors.Wrap(err, "worker error")
+				log.Error(err)
+				w.judgeError(ctx, err)
+				break
+			}
+		}
+		err = w.postRun(ctx, tinfo, res, sc)
+		if err != nil {
+			w.cleanup(ctx)
+			err = errors.Wrap(err, "worker error")
+			log.Error(err)
+			w.judgeError(ctx, err)
+			break
+		}
+		log.Infof("Judge Testcase %d OK", tinfo.Rank)
+		if sc.stop(res) {
+			break
+		}
+	}
+	if r, ok := w.judgeServer.(server.ScoreReporter); ok && finished && w.JudgeInfo.Scoring != config.ScoringICPC {
+		err = r.PostScore(ctx, w.JudgeInfo, sc.score())
+		if err != nil {
+			err = errors.Wrap(&server.ServerError{Err: err}, "worker error")
+			log.Error(err)
+			w.judgeError(ctx, err)
+		}
+	}
+	err = w.cleanup(ctx)
+	if err != nil {
+		log.Error(err)
+		return
 	}
-	cpuid = -1
 	return
 }
+
+// judgeError reports the error of the judging, unless the judging is
+// canceled by a drain and given back instead
+func (w *Worker) judgeError(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		log.Warnf("judging %d canceled: %s", w.JudgeInfo.JudgingID, err)
+		return
+	}
+	w.judgeServer.JudgeError(ctx, w.JudgeInfo, err)
+}
@@ -0,0 +1,142 @@
+package controller
+
+// Allocate CPU cores to the workers, every judging runs on a physical core
+// of its own so the hyperthread sibling can not disturb the time
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SysCPURoot is where the kernel exposes the CPU topology
+var SysCPURoot = "/sys/devices/system/cpu"
+
+type CPUAllocator struct {
+	mu    sync.Mutex
+	cores []int // One logical CPU of each physical core judgings can run on
+	used  map[int]bool
+}
+
+// NewCPUAllocator creates an allocator of cpus, all online CPUs if cpus is
+// empty. A physical core is used when none of its hyperthreads is reserved,
+// and only its first hyperthread in cpus is given out
+func NewCPUAllocator(cpus []int, reserved []int) (a *CPUAllocator, err error) {
+	if len(cpus) == 0 {
+		data, er := ioutil.ReadFile(filepath.Join(SysCPURoot, "online"))
+		if er != nil {
+			err = errors.Wrap(er, "create cpu allocator error")
+			return
+		}
+		cpus, err = parseCPUList(string(data))
+		if err != nil {
+			err = errors.Wrap(err, "create cpu allocator error")
+			return
+		}
+	}
+	isReserved := make(map[int]bool)
+	for _, c := range reserved {
+		isReserved[c] = true
+	}
+	a = &CPUAllocator{used: make(map[int]bool)}
+	taken := make(map[int]bool) // CPUs whose physical core is taken or reserved
+	// Sort a copy, the list belongs to the config
+	cpus = append([]int(nil), cpus...)
+	sort.Ints(cpus)
+	for _, c := range cpus {
+		if taken[c] {
+			continue
+		}
+		siblings, er := cpuSiblings(c)
+		if er != nil {
+			err = errors.Wrap(er, "create cpu allocator error")
+			return
+		}
+		ok := true
+		for _, s := range siblings {
+			taken[s] = true
+			if isReserved[s] {
+				ok = false
+			}
+		}
+		if ok {
+			a.cores = append(a.cores, c)
+		}
+	}
+	if len(a.cores) == 0 {
+		err = errors.New("create cpu allocator error: no cpu left for judging")
+		return
+	}
+	return
+}
+
+// Len returns the number of cores can be allocated
+func (a *CPUAllocator) Len() int {
+	return len(a.cores)
+}
+
+// Get allocates a free core
+func (a *CPUAllocator) Get() (cpuid int, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.cores {
+		if !a.used[c] {
+			a.used[c] = true
+			cpuid = c
+			return
+		}
+	}
+	err = errors.New("allocate cpu error: all cpus are in use")
+	return
+}
+
+// Put releases the core got by Get
+func (a *CPUAllocator) Put(cpuid int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.used, cpuid)
+}
+
+// cpuSiblings returns the hyperthreads on the same physical core as cpu,
+// including itself
+func cpuSiblings(cpu int) (siblings []int, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(SysCPURoot, fmt.Sprintf("cpu%d", cpu), "topology", "thread_siblings_list"))
+	if err != nil {
+		return
+	}
+	siblings, err = parseCPUList(string(data))
+	return
+}
+
+// parseCPUList parses the kernel cpu list format like 0-3,8,10-11
+func parseCPUList(list string) (cpus []int, err error) {
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		first, er := strconv.Atoi(bounds[0])
+		if er != nil {
+			err = errors.Wrap(er, "parse cpu list error")
+			return
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, er = strconv.Atoi(bounds[1])
+			if er != nil {
+				err = errors.Wrap(er, "parse cpu list error")
+				return
+			}
+		}
+		for c := first; c <= last; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return
+}
@@ -0,0 +1,488 @@
+package controller
+
+// The docker sandbox, one client shared by all workers of the daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/VOID001/D-judge/config"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// HealthCheckInterval is how often the docker daemon is pinged
+const HealthCheckInterval = 10 * time.Second
+
+// DockerClient is the Sandbox on docker, it keeps one client with its
+// connections and reconnects when the docker daemon is back after a restart
+type DockerClient struct {
+	mu      sync.Mutex
+	cli     dockerAPI
+	dial    func(ctx context.Context) (dockerAPI, error) // dialDocker if nil
+	healthy bool
+	err     error // Why it is not healthy
+}
+
+// dockerAPI is the part of the docker client used, *client.Client
+type dockerAPI interface {
+	Ping(ctx context.Context) (types.Ping, error)
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error)
+	ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error
+	ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error
+	ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error
+	ContainerInspect(ctx context.Context, containerID string) (container.InspectResponse, error)
+	ContainerUpdate(ctx context.Context, containerID string, updateConfig container.UpdateConfig) (container.UpdateResponse, error)
+	ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error)
+	ContainerDiff(ctx context.Context, containerID string) ([]container.FilesystemChange, error)
+	ContainerTop(ctx context.Context, containerID string, arguments []string) (container.TopResponse, error)
+	ContainerExecCreate(ctx context.Context, containerID string, options container.ExecOptions) (container.ExecCreateResponse, error)
+	ContainerExecAttach(ctx context.Context, execID string, config container.ExecAttachOptions) (types.HijackedResponse, error)
+	ContainerExecInspect(ctx context.Context, execID string) (container.ExecInspect, error)
+	Close() error
+}
+
+// NewDockerClient connects to the docker daemon of the config
+func NewDockerClient(ctx context.Context) (d *DockerClient, err error) {
+	d = &DockerClient{}
+	_, err = d.client(ctx)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// dialDocker connects to the docker daemon of the config, the API version
+// is negotiated with the docker daemon unless docker_version is set
+func dialDocker(ctx context.Context) (api dockerAPI, err error) {
+	opts := []client.Opt{client.WithHost(config.GlobalConfig.DockerServer)}
+	if config.GlobalConfig.DockerVersion == "" {
+		opts = append(opts, client.WithAPIVersionNegotiation())
+	} else {
+		opts = append(opts, client.WithVersion(strings.TrimPrefix(config.GlobalConfig.DockerVersion, "v")))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return
+	}
+	cli.NegotiateAPIVersion(ctx)
+	sv, err := cli.ServerVersion(ctx)
+	if err != nil {
+		cli.Close()
+		return
+	}
+	log.Infof("connected to docker %s, API version %s", sv.Version, cli.ClientVersion())
+	api = cli
+	return
+}
+
+// client returns the client, reconnecting first if the docker daemon was gone
+// The other callers are not held up by the dial, the new client is swapped
+// in afterwards unless one of them reconnected meanwhile
+func (d *DockerClient) client(ctx context.Context) (cli dockerAPI, err error) {
+	d.mu.Lock()
+	if d.healthy {
+		cli = d.cli
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Unlock()
+	dial := d.dial
+	if dial == nil {
+		dial = dialDocker
+	}
+	cli, err = dial(ctx)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		err = errors.Wrap(err, "connect docker error")
+		d.err = err
+		return
+	}
+	if d.healthy {
+		cli.Close()
+		cli = d.cli
+		return
+	}
+	if d.cli != nil {
+		d.cli.Close()
+	}
+	d.cli = cli
+	d.healthy = true
+	d.err = nil
+	return
+}
+
+// unhealthy marks the client unhealthy after cli failed with err, so the
+// next call reconnects. A client replaced meanwhile is left alone
+func (d *DockerClient) unhealthy(cli dockerAPI, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cli != cli {
+		return
+	}
+	if d.healthy {
+		log.Errorf("docker becomes unhealthy: %s", err)
+	}
+	d.healthy = false
+	d.err = err
+}
+
+// check marks the client unhealthy if err of a container operation of cli
+// tells the docker daemon can not be reached
+func (d *DockerClient) check(cli dockerAPI, err error) {
+	if client.IsErrConnectionFailed(err) {
+		d.unhealthy(cli, errors.Wrap(err, "docker connection error"))
+	}
+}
+
+// Healthy tells whether the docker daemon answered the last check, err is why not
+func (d *DockerClient) Healthy() (healthy bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.healthy, d.err
+}
+
+// Ping checks the docker daemon, reconnecting if it was gone
+func (d *DockerClient) Ping(ctx context.Context) (err error) {
+	cli, err := d.client(ctx)
+	if err != nil {
+		return
+	}
+	_, err = cli.Ping(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "ping docker server error")
+		d.unhealthy(cli, err)
+		return
+	}
+	return
+}
+
+// Watch pings the docker daemon every HealthCheckInterval until ctx is done
+func (d *DockerClient) Watch(ctx context.Context) {
+	t := time.NewTicker(HealthCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		was, _ := d.Healthy()
+		err := d.Ping(ctx)
+		if err == nil && !was {
+			log.Infof("docker is healthy again")
+		}
+	}
+}
+
+func (d *DockerClient) Create(ctx context.Context, spec ContainerSpec) (id string, err error) {
+	cli, err := d.client(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "create container error")
+		return
+	}
+	cfg := container.Config{}
+	cfg.Image = spec.Image
+	cfg.WorkingDir = SandboxRoot
+	cfg.User = "root" // The program is run as Worker.RunUser
+	cfg.Env = []string{"HOME=/tmp"}
+	cfg.NetworkDisabled = true
+	cfg.Tty = true
+	cfg.AttachStdin = false
+	cfg.AttachStderr = false
+	cfg.AttachStdout = false
+	cfg.Cmd = []string{"/bin/bash"}
+	cfg.Labels = spec.Labels
+	hcfg := container.HostConfig{}
+	hcfg.Binds = []string{fmt.Sprintf("%s:%s", spec.Dir, SandboxRoot)}
+	// Only SandboxRoot and /tmp are writable, and /tmp only by root
+	hcfg.ReadonlyRootfs = true
+	hcfg.Tmpfs = map[string]string{"/tmp": "rw,exec,nosuid,nodev,mode=755"}
+	hcfg.NetworkMode = "none"
+	// A private IPC namespace without /dev/shm, the SysV objects are removed
+	// by the container pool
+	hcfg.IpcMode = "none"
+	hcfg.CapDrop = []string{"ALL"}
+	hcfg.CapAdd = spec.Caps
+	profile, err := dockerSeccomp(spec.Seccomp)
+	if err != nil {
+		err = errors.Wrap(err, "create container error")
+		return
+	}
+	hcfg.SecurityOpt = []string{"seccomp=" + profile}
+	hcfg.CpusetCpus = fmt.Sprintf("%d", spec.CPU)
+	hcfg.Memory = spec.Memory
+	hcfg.MemorySwap = spec.Memory
+	pids := spec.Pids
+	hcfg.PidsLimit = &pids
+
+	resp, err := cli.ContainerCreate(ctx, &cfg, &hcfg, nil, nil, "")
+	if err != nil {
+		d.check(cli, err)
+		err = errors.Wrap(err, "create container error")
+		return
+	}
+	id = resp.ID
+	err = cli.ContainerStart(ctx, id, container.StartOptions{})
+	if err != nil {
+		d.check(cli, err)
+		cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+		err = errors.Wrap(err, "create container error")
+		return
+	}
+	return
+}
+
+// dockerSeccomp returns the seccomp profile killing the process on the
+// denied syscalls and clone with NamespaceCloneFlags, it replaces the
+// default profile of docker. The syscalls of all architectures of the
+// judgehost are filtered, or the 32 bit ones would get around the profile
+func dockerSeccomp(denied []string) (profile string, err error) {
+	archs := map[string][]string{
+		"amd64": {"SCMP_ARCH_X86_64", "SCMP_ARCH_X86", "SCMP_ARCH_X32"},
+		"arm64": {"SCMP_ARCH_AARCH64", "SCMP_ARCH_ARM"},
+	}
+	type arg struct {
+		Index    uint   `json:"index"`
+		Value    uint64 `json:"value"`
+		ValueTwo uint64 `json:"valueTwo"`
+		Op       string `json:"op"`
+	}
+	type rule struct {
+		Names    []string `json:"names"`
+		Action   string   `json:"action"`
+		Args     []arg    `json:"args,omitempty"`
+		ErrnoRet *uint    `json:"errnoRet,omitempty"`
+	}
+	p := struct {
+		DefaultAction string   `json:"defaultAction"`
+		Architectures []string `json:"architectures,omitempty"`
+		Syscalls      []rule   `json:"syscalls"`
+	}{
+		DefaultAction: "SCMP_ACT_ALLOW",
+		Architectures: archs[runtime.GOARCH],
+		Syscalls:      []rule{{Names: denied, Action: "SCMP_ACT_KILL_PROCESS"}},
+	}
+	// The rules of a syscall match if any does, one per flag
+	for flag := uint64(1); flag < 1<<32; flag <<= 1 {
+		if NamespaceCloneFlags&flag != 0 {
+			cond := arg{Index: 0, Value: flag, ValueTwo: flag, Op: "SCMP_CMP_MASKED_EQ"}
+			p.Syscalls = append(p.Syscalls, rule{Names: []string{"clone"}, Action: "SCMP_ACT_KILL_PROCESS", Args: []arg{cond}})
+		}
+	}
+	clone3 := false
+	for _, s := range denied {
+		clone3 = clone3 || s == "clone3"
+	}
+	if !clone3 {
+		enosys := uint(unix.ENOSYS)
+		p.Syscalls = append(p.Syscalls, rule{Names: []string{"clone3"}, Action: "SCMP_ACT_ERRNO", ErrnoRet: &enosys})
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		err = errors.Wrap(err, "build seccomp profile error")
+		return
+	}
+	profile = string(data)
+	return
+}
+
+// hijacked closes the connection of the attached stream
+type hijacked struct {
+	types.HijackedResponse
+}
+
+func (h hijacked) Read(p []byte) (n int, err error) {
+	return h.Reader.Read(p)
+}
+
+func (h hijacked) Close() error {
+	h.HijackedResponse.Close()
+	return nil
+}
+
+func (d *DockerClient) Exec(ctx context.Context, id string, user string, cmd string) (execID string, output io.ReadCloser, err error) {
+	cli, err := d.client(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "exec command in container error")
+		return
+	}
+	ec := container.ExecOptions{}
+	ec.Detach = false
+	ec.Tty = false
+	ec.AttachStdout = true
+	ec.AttachStderr = true
+	ec.Cmd = []string{"/bin/bash", "-c", cmd}
+	ec.User = user
+	log.Debugf("%+v", ec)
+	eresp, err := cli.ContainerExecCreate(ctx, id, ec)
+	if err != nil {
+		d.check(cli, err)
+		err = errors.Wrap(err, "exec command in container error")
+		return
+	}
+	execID = eresp.ID
+	// Attach starts the exec too
+	resp, err := cli.ContainerExecAttach(ctx, execID, container.ExecAttachOptions{})
+	if err != nil {
+		d.check(cli, err)
+		err = errors.Wrap(err, "exec command in container error")
+		return
+	}
+	output = hijacked{resp}
+	return
+}
+
+func (d *DockerClient) ExecInspect(ctx context.Context, execID string) (info ExecInfo, err error) {
+	cli, err := d.client(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "inspect exec error")
+		return
+	}
+	insp, err := cli.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		d.check(cli, err)
+		err = errors.Wrap(err, "inspect exec error")
+		return
+	}
+	info.Running = insp.Running
+	info.ExitCode = insp.ExitCode
+	return
+}
+
+func (d *DockerClient) Inspect(ctx context.Context, id string) (state ContainerState, err error) {
+	cli, err := d.client(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "inspect container error")
+		return
+	}
+	insp, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		d.check(cli, err)
+		err = errors.Wrap(err, "inspect container error")
+		return
+	}
+	if insp.ContainerJSONBase == nil || insp.State == nil {
+		err = errors.New("inspect container error: no state")
+		return
+	}
+	state.Running = insp.State.Running
+	state.Pid = insp.State.Pid
+	return
+}
+
+func (d *DockerClient) SetMemory(ctx context.Context, id string, lim int64) (err error) {
+	cli, err := d.client(ctx)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("set memory limit to %d error", lim))
+		return
+	}
+	ucfg := container.UpdateConfig{}
+	ucfg.Memory = lim
+	ucfg.MemorySwap = lim
+	_, err = cli.ContainerUpdate(ctx, id, ucfg)
+	if err != nil {
+		d.check(cli, err)
+		err = errors.Wrap(err, fmt.Sprintf("set memory limit to %d error", lim))
+		return
+	}
+	return
+}
+
+func (d *DockerClient) Stop(ctx context.Context, id string) (err error) {
+	cli, err := d.client(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "stop container error")
+		return
+	}
+	err = cli.ContainerStop(ctx, id, container.StopOptions{})
+	if err != nil {
+		d.check(cli, err)
+		err = errors.Wrap(err, "stop container error")
+		return
+	}
+	return
+}
+
+func (d *DockerClient) Remove(ctx context.Context, id string) (err error) {
+	cli, err := d.client(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "remove container error")
+		return
+	}
+	err = cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true})
+	if err != nil {
+		d.check(cli, err)
+		err = errors.Wrap(err, "remove container error")
+		return
+	}
+	return
+}
+
+func (d *DockerClient) List(ctx context.Context, label string, value string) (list []ContainerInfo, err error) {
+	cli, err := d.client(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "list containers error")
+		return
+	}
+	f := filters.NewArgs(filters.Arg("label", fmt.Sprintf("%s=%s", label, value)))
+	cs, err := cli.ContainerList(ctx, container.ListOptions{All: true, Filters: f})
+	if err != nil {
+		d.check(cli, err)
+		err = errors.Wrap(err, "list containers error")
+		return
+	}
+	for _, c := range cs {
+		list = append(list, ContainerInfo{ID: c.ID, Labels: c.Labels})
+	}
+	return
+}
+
+func (d *DockerClient) Changes(ctx context.Context, id string) (changes map[string]bool, err error) {
+	cli, err := d.client(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "diff container error")
+		return
+	}
+	diff, err := cli.ContainerDiff(ctx, id)
+	if err != nil {
+		d.check(cli, err)
+		err = errors.Wrap(err, "diff container error")
+		return
+	}
+	changes = make(map[string]bool)
+	for _, ch := range diff {
+		changes[fmt.Sprintf("%d %s", ch.Kind, ch.Path)] = true
+	}
+	return
+}
+
+func (d *DockerClient) Processes(ctx context.Context, id string) (n int, err error) {
+	cli, err := d.client(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "list processes error")
+		return
+	}
+	top, err := cli.ContainerTop(ctx, id, nil)
+	if err != nil {
+		d.check(cli, err)
+		err = errors.Wrap(err, "list processes error")
+		return
+	}
+	n = len(top.Processes)
+	return
+}
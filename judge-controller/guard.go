@@ -4,190 +4,275 @@ package controller
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/docker/engine-api/client"
-	"github.com/docker/engine-api/types"
 	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
-	"github.com/shirou/gopsutil/process"
 )
 
-func (w *Worker) runProtect(ctx context.Context, insp *types.ContainerJSON, pid int, timelim uint64, outputlim int64, outputfile string) (info runinfo, err error) {
-	starttime := time.Now().UnixNano()
-	curtime := time.Now().UnixNano()
+// Files of the handshake of the measured part of a command with the
+// judgehost, fifos in the work dir, see measured
+const (
+	MeasurePid = "run.pid"
+	MeasureGo  = "run.go"
+)
+
+// MemorySampleInterval is how often memory.current is sampled on kernels
+// without memory.peak
+const MemorySampleInterval = 10 * time.Millisecond
 
-	// Use run protect to protect the running instance
-	// It will start right after the execmd =w=
-	info.outputexceed = false
-	info.usedmem = 0
-	info.usedtime = 0
-	info.timeexceed = false
-	p, err := process.NewProcess(int32(pid))
+// measured wraps the part of a command runProtect measures. It tells its
+// pid to the judgehost, which moves it into the run cgroup, and waits for
+// that before exec-ing cmd, so cmd and its children are all counted
+func measured(cmd string) string {
+	script := fmt.Sprintf("echo $$ > %s && read go < %s && exec /bin/bash -c %s", filepath.Join(SandboxRoot, MeasurePid), filepath.Join(SandboxRoot, MeasureGo), shellQuote(cmd))
+	return "/bin/sh -c " + shellQuote(script)
+}
+
+// runProtect runs cmd in the container and guards it until it exits, the
+// part of cmd wrapped by measured is run in a fresh cgroup limited to
+// memlim bytes (0 for the limit of the container) and its usage is filled
+// into info. timelim is the hard wall time limit. The exit of the command
+// is noticed by the end of its attached stream, OOM kills by the cgroup
+// events (cgroup v2 only, on v1 the killed program simply exits) and the
+// time limit by a timer, only the memory is polled on kernels without
+// memory.peak. The output limit is enforced by the command itself, the
+// size of outputfile is only checked after the exit
+func (w *Worker) runProtect(ctx context.Context, user string, cmd string, memlim int64, timelim time.Duration, outputlim int64, outputfile string) (info runinfo, einfo ExecInfo, err error) {
+	run, err := w.cg.newRun(memlim)
 	if err != nil {
-		err = errors.Wrap(err, "run protect error: cannot attach process")
+		err = errors.Wrap(err, "run protect error")
 		return
 	}
-	m, err := p.MemoryInfoEx()
-	if err != nil {
-		err = errors.Wrap(err, "run protect error: cannot get memory info")
+	defer func() {
+		er := run.remove()
+		if er != nil {
+			log.Warn(errors.Wrap(er, "run protect error"))
+		}
+	}()
+	pidfifo := filepath.Join(w.WorkDir, MeasurePid)
+	gofifo := filepath.Join(w.WorkDir, MeasureGo)
+	for _, f := range []string{pidfifo, gofifo} {
+		os.Remove(f)
+		err = syscall.Mkfifo(f, TestcasePerm)
+		if err != nil {
+			err = errors.Wrap(err, "run protect error: cannot create fifo")
+			return
+		}
+		defer os.Remove(f)
 	}
-	var f os.FileInfo
-	if outputfile != "" {
-		f, err = os.Stat(outputfile)
-		if err != nil && !os.IsNotExist(err) {
-			err = errors.Wrap(err, "run protect error: cannot get output file")
+
+	var oomev chan fsnotify.Event
+	if run.v2 {
+		wt, er := fsnotify.NewWatcher()
+		if er != nil {
+			err = errors.Wrap(er, "run protect error: cannot create watcher")
 			return
 		}
+		defer wt.Close()
+		err = wt.Add(filepath.Join(run.memory, "memory.events"))
+		if err != nil {
+			err = errors.Wrap(err, "run protect error: cannot watch memory events")
+			return
+		}
+		oomev = wt.Events
 	}
-	wt, er := fsnotify.NewWatcher()
-	if er != nil {
-		err = errors.Wrap(er, "run protect error: cannot create watcher")
-		return
+	var sample <-chan time.Time
+	if !run.peak {
+		t := time.NewTicker(MemorySampleInterval)
+		defer t.Stop()
+		sample = t.C
 	}
-	defer wt.Close()
-	err = wt.Add(w.WorkDir)
+
+	starttime := time.Now()
+	id, output, err := w.startcmd(ctx, user, cmd)
 	if err != nil {
-		err = errors.Wrap(err, "run protect error: cannot add watchpoint")
+		err = errors.Wrap(err, "run protect error")
 		return
 	}
-	log.Debugf("Add watch to %s", w.WorkDir)
+	defer output.Close()
+	done := make(chan struct{})
+	go func() {
+		// The stream ends when the command exits
+		io.Copy(ioutil.Discard, output)
+		close(done)
+	}()
+	attached := make(chan error, 1)
+	go func() {
+		attached <- w.attachRun(run, pidfifo, gofifo)
+	}()
+	attachErr := errors.New("the measured command did not start")
+	timer := time.NewTimer(timelim)
+	defer timer.Stop()
+
 Loop:
 	for {
 		select {
-		case ev := <-wt.Events:
-			log.Debugf("%s", ev.String())
-			if ev.Op == fsnotify.Create && strings.HasSuffix(ev.Name, "done.lck") {
-				curtime = time.Now().UnixNano()
-				break Loop
-			}
-		default:
-			curtime = time.Now().UnixNano()
-			// Only when output file is not empty, check the file size
-			if outputfile != "" {
-				f, err = os.Stat(outputfile)
-				if err != nil && !os.IsNotExist(err) {
-					err = errors.Wrap(err, "run protect error: cannot stat outputfile")
-					break Loop
-				}
-				// Output Limit exceed
-				if err == nil && f.Size() > outputlim {
-					info.outputexceed = true
-					break Loop
-				}
-			}
-			// Collect memory used
-			if info.usedmem < m.Dirty {
-				info.usedmem = m.Dirty
+		case <-done:
+			break Loop
+		case attachErr = <-attached:
+			attached = nil
+			if attachErr != nil {
+				// Nothing is left unmeasured
+				w.cg.killAll()
 			}
-			// Time limit exceed
-			if curtime-starttime > int64(timelim*1000000000) {
-				info.timeexceed = true
-				log.Debugf("Program exceed hard time limit(used %d, hardlim %d), terminated now", curtime-starttime, timelim*1000000000)
-				// Killed the program
-				err = p.Terminate()
-				if err != nil {
-					p.Kill()
-				}
+		case <-sample:
+			run.sample()
+		case <-timer.C:
+			info.timeexceed = true
+			log.Debugf("Program exceed hard time limit %s, terminated now", timelim)
+			w.cg.killAll()
+			<-done
+			break Loop
+		case <-oomev:
+			cur, er := run.oomKills()
+			if er == nil && cur > 0 {
+				info.memexceed = true
+				log.Debugf("Program killed by OOM killer, terminate the rest")
+				w.cg.killAll()
+				<-done
 				break Loop
 			}
-			// done.lck create too quick, then just get it and exit
-			_, err = os.Stat(filepath.Join(w.WorkDir, "done.lck"))
-			if err == nil {
-				break Loop
+		case <-ctx.Done():
+			w.cg.killAll()
+			<-done
+			if attached != nil {
+				unblockAttach(pidfifo, gofifo, attached)
 			}
-
+			err = errors.Wrap(ctx.Err(), "run protect error")
+			return
 		}
 	}
-	info.usedtime = curtime - starttime
-	info.memexceed = insp.State.OOMKilled
-	err = os.RemoveAll(filepath.Join(w.WorkDir, "done.lck"))
+	info.usedtime = int64(time.Since(starttime))
+	if attached != nil {
+		attachErr = unblockAttach(pidfifo, gofifo, attached)
+	}
+	if attachErr != nil {
+		err = errors.Wrap(attachErr, "run protect error")
+		return
+	}
+
+	einfo, err = w.sandbox.ExecInspect(ctx, id)
+	if err != nil {
+		err = errors.Wrap(err, "run protect error: inspect exec")
+		return
+	}
+	info.usedmem, err = run.peakMemory()
+	if err != nil {
+		err = errors.Wrap(err, "run protect error")
+		return
+	}
+	oom, err := run.oomKills()
+	if err != nil {
+		err = errors.Wrap(err, "run protect error")
+		return
+	}
+	if oom > 0 {
+		info.memexceed = true
+	}
+	cpu, err := run.cpuUsage()
 	if err != nil {
-		err = errors.Wrap(err, "cannot remove done.lck [ABORT!]")
+		err = errors.Wrap(err, "run protect error")
 		return
 	}
+	info.usedcpu = int64(cpu)
+	if outputfile != "" && outputlim > 0 {
+		f, er := os.Stat(filepath.Join(w.WorkDir, outputfile))
+		if er != nil && !os.IsNotExist(er) {
+			err = errors.Wrap(er, "run protect error: cannot stat outputfile")
+			return
+		}
+		if er == nil && f.Size() > outputlim {
+			info.outputexceed = true
+		}
+	}
 	return
 }
 
-func (w *Worker) execcmd(ctx context.Context, cli *client.Client, user string, cmd string) (info types.ContainerExecInspect, err error) {
-	ec := types.ExecConfig{}
-	ec.Detach = true
-	ec.Tty = false
-	ec.AttachStdout = true // Set this to true will make the command block until finish
-	ec.Cmd = make([]string, 3)
-	ec.Cmd[0] = "/bin/bash"
-	ec.Cmd[1] = "-c"
-	ec.Cmd[2] = cmd
-	log.Infof("%+v", ec)
-	ec.User = user
-	eresp, er := cli.ContainerExecCreate(ctx, w.containerID, ec)
-	if er != nil {
-		err = errors.Wrap(er, "exec command in container error")
-		return
-	}
-	sc := types.ExecStartCheck{}
-	sc.Tty = ec.Tty
-	sc.Detach = ec.Detach
-	log.Infof("ExecStartCheck %+v", sc)
-	err = cli.ContainerExecStart(ctx, eresp.ID, sc)
+// attachRun does the handshake of the measured part of the command: reads
+// its pid, moves it into the run cgroup and lets it go on
+func (w *Worker) attachRun(run *cgroup, pidfifo string, gofifo string) (err error) {
+	// Blocks until the command opens the fifo
+	data, err := ioutil.ReadFile(pidfifo)
 	if err != nil {
-		err = errors.Wrap(err, "exec command in container error")
+		err = errors.Wrap(err, "attach run error")
 		return
 	}
-	log.Debugf("Executing exec ID = %s", eresp.ID)
-	info, err = cli.ContainerExecInspect(ctx, eresp.ID)
+	nspid, err := strconv.Atoi(strings.TrimSpace(string(data)))
 	if err != nil {
-		err = errors.Wrap(err, "exec command in container error")
+		err = errors.Wrap(err, "attach run error: the measured command did not start")
+		return
+	}
+	err = run.attach(w.cg, nspid)
+	if err != nil {
+		err = errors.Wrap(err, "attach run error")
+		return
+	}
+	f, err := os.OpenFile(gofifo, os.O_WRONLY, 0)
+	if err != nil {
+		err = errors.Wrap(err, "attach run error")
+		return
+	}
+	defer f.Close()
+	_, err = f.WriteString("go\n")
+	if err != nil {
+		err = errors.Wrap(err, "attach run error")
 		return
 	}
-	log.Infof("ONLY FOR CURRENT DEBUG info.ExitCode = %d", info.ExitCode)
 	return
 }
 
-func (w *Worker) execcmdAttach(ctx context.Context, cli *client.Client, user string, cmd string) (info types.ContainerExecInspect, err error) {
-	ec := types.ExecConfig{}
-	ec.Detach = false
-	ec.Tty = false
-	ec.AttachStdout = true // Set this to true will make the command block until finish
-	ec.Cmd = make([]string, 3)
-	ec.Cmd[0] = "/bin/bash"
-	ec.Cmd[1] = "-c"
-	ec.Cmd[2] = cmd
-	log.Infof("%+v", ec)
-	ec.User = user
-	eresp, er := cli.ContainerExecCreate(ctx, w.containerID, ec)
-	if er != nil {
-		err = errors.Wrap(er, "exec command in container error")
-		return
-	}
-	sc := types.ExecStartCheck{}
-	sc.Tty = ec.Tty
-	sc.Detach = ec.Detach
-	log.Infof("ExecStartCheck %+v", sc)
-	err = cli.ContainerExecStart(ctx, eresp.ID, sc)
+// unblockAttach ends attachRun blocked on a fifo of a command exited
+// before the handshake, by opening the other end of it
+func unblockAttach(pidfifo string, gofifo string, attached chan error) (err error) {
+	for {
+		select {
+		case err = <-attached:
+			return
+		case <-time.After(MemorySampleInterval):
+		}
+		if f, er := os.OpenFile(pidfifo, os.O_WRONLY|syscall.O_NONBLOCK, 0); er == nil {
+			f.Close()
+		}
+		if f, er := os.OpenFile(gofifo, os.O_RDONLY|syscall.O_NONBLOCK, 0); er == nil {
+			f.Close()
+		}
+	}
+}
+
+// startcmd starts cmd in the container, the command exits when output ends
+func (w *Worker) startcmd(ctx context.Context, user string, cmd string) (id string, output io.ReadCloser, err error) {
+	id, output, err = w.sandbox.Exec(ctx, w.containerID, user, cmd)
 	if err != nil {
 		err = errors.Wrap(err, "exec command in container error")
 		return
 	}
-	insp, err := cli.ContainerExecAttach(ctx, eresp.ID, ec)
+	log.Debugf("Executing exec ID = %s", id)
+	return
+}
+
+// execcmd runs cmd in the container and waits until it exits
+func (w *Worker) execcmd(ctx context.Context, user string, cmd string) (info ExecInfo, err error) {
+	id, output, err := w.startcmd(ctx, user, cmd)
+	if err != nil {
+		return
+	}
+	defer output.Close()
+	_, err = io.Copy(ioutil.Discard, output)
 	if err != nil {
 		err = errors.Wrap(err, "exec command in container error")
+		return
 	}
-	c := insp.Conn
-	defer insp.Close()
-
-	log.Debugf("Executing exec ID = %s", eresp.ID)
-	one := make([]byte, 1)
-	_, err = c.Read(one)
-	if err == io.EOF {
-		log.Infof("Connection Closed")
-	}
-	info, err = cli.ContainerExecInspect(ctx, eresp.ID)
+	info, err = w.sandbox.ExecInspect(ctx, id)
 	if err != nil {
 		err = errors.Wrap(err, "exec command in container error")
 		return
@@ -0,0 +1,196 @@
+package controller
+
+// Journal of the judgings in progress, so a judgehost crashed in the middle
+// of judging can clean up and resume (or give back) the judgings on restart
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/VOID001/D-judge/config"
+	"github.com/pkg/errors"
+)
+
+// Labels of the containers created by the judgehost, used to find the
+// containers left by a crash
+const (
+	LabelHost    = "d-judge.host"
+	LabelJudging = "d-judge.judging" // Not set on warm containers
+	LabelRun     = "d-judge.run"     // Tells this run of the judgehost from earlier ones
+)
+
+// Judging states saved in the journal
+const (
+	StatePrepare = "prepare"
+	StateBuild   = "build"
+	StateRun     = "run"
+)
+
+type journalEntry struct {
+	JudgeInfo   config.JudgeInfo `json:"judge_info"`
+	WorkDir     string           `json:"work_dir"`
+	State       string           `json:"state"`
+	Rank        int64            `json:"rank"` // Rank of the last reported testcase
+	ContainerID string           `json:"container_id"`
+}
+
+// saveJournal records the state of the judging, the journal is only for
+// recovery so errors are logged and ignored
+func (w *Worker) saveJournal(state string) {
+	if w.journalDir == "" {
+		return
+	}
+	w.state = state
+	dir := w.WorkDir
+	if w.judgingDir != "" {
+		dir = w.judgingDir
+	}
+	e := journalEntry{
+		JudgeInfo:   w.JudgeInfo,
+		WorkDir:     dir,
+		State:       state,
+		Rank:        w.rank,
+		ContainerID: w.containerID,
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Warn(errors.Wrap(err, "save journal error"))
+		return
+	}
+	// Write and rename so a crash never leaves a half written entry
+	path := filepath.Join(w.journalDir, fmt.Sprintf("j%d.json", w.JudgeInfo.JudgingID))
+	err = ioutil.WriteFile(path+".tmp", data, FilePerm)
+	if err != nil {
+		log.Warn(errors.Wrap(err, "save journal error"))
+		return
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		log.Warn(errors.Wrap(err, "save journal error"))
+		return
+	}
+}
+
+// removeJournal removes the judging from the journal when it is done
+func (w *Worker) removeJournal() {
+	if w.journalDir == "" {
+		return
+	}
+	err := os.Remove(filepath.Join(w.journalDir, fmt.Sprintf("j%d.json", w.JudgeInfo.JudgingID)))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn(errors.Wrap(err, "remove journal error"))
+	}
+}
+
+func readJournal(dir string) (entries []journalEntry, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		err = errors.Wrap(err, "read journal error")
+		return
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, er := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if er != nil {
+			err = errors.Wrap(er, "read journal error")
+			return
+		}
+		e := journalEntry{}
+		er = json.Unmarshal(data, &e)
+		if er != nil {
+			log.Warnf("skip broken journal entry %s: %s", f.Name(), er)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return
+}
+
+// Recover cleans up what is left by a crash of the judgehost, it should be
+// called after Run. Containers created by this host are removed, the
+// judgings in the journal are resumed if resume is true and the judge
+// server supports it, otherwise they are given back to the judge server
+func (d *Daemon) Recover(ctx context.Context, resume bool) (err error) {
+	err = d.removeOrphanContainers(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "recover error")
+		return
+	}
+	if d.JournalDir == "" {
+		return
+	}
+	entries, err := readJournal(d.JournalDir)
+	if err != nil {
+		err = errors.Wrap(err, "recover error")
+		return
+	}
+	for _, e := range entries {
+		// A journal left there would be replayed on every restart
+		err = os.Remove(filepath.Join(d.JournalDir, fmt.Sprintf("j%d.json", e.JudgeInfo.JudgingID)))
+		if err != nil && !os.IsNotExist(err) {
+			err = errors.Wrap(err, "recover error: remove journal")
+			return
+		}
+		err = nil
+		log.Warnf("found unfinished judging %d of submission %d in state %s, testcase %d reported", e.JudgeInfo.JudgingID, e.JudgeInfo.SubmitID, e.State, e.Rank)
+		resumed, er := d.Server.RecoverJudging(ctx, e.JudgeInfo, resume)
+		if er != nil {
+			log.Error(errors.Wrap(er, "recover error"))
+			continue
+		}
+		// Keep the work dir for debugging, the judging restarts in a new one
+		if _, er := os.Stat(e.WorkDir); er == nil {
+			oldWorkDir := fmt.Sprintf("%s-old-%d", e.WorkDir, time.Now().Unix())
+			er = os.Rename(e.WorkDir, oldWorkDir)
+			if er != nil {
+				log.Error(errors.Wrap(er, "recover error"))
+				continue
+			}
+		}
+		if !resumed {
+			continue
+		}
+		er = os.Mkdir(e.WorkDir, DirPerm)
+		if er != nil {
+			er = errors.Wrap(er, "recover error: create work dir")
+			log.Error(er)
+			d.Server.JudgeError(ctx, e.JudgeInfo, er)
+			continue
+		}
+		w := d.newWorker(e.JudgeInfo, e.WorkDir, config.GlobalConfig.DockerImage)
+		w.rank = e.Rank
+		log.Infof("resume judging %d after testcase %d", e.JudgeInfo.JudgingID, e.Rank)
+		d.enqueue(w)
+	}
+	return
+}
+
+// removeOrphanContainers removes all containers created by earlier runs of
+// this host, no judging is running when it is called
+func (d *Daemon) removeOrphanContainers(ctx context.Context) (err error) {
+	list, err := d.Sandbox.List(ctx, LabelHost, config.GlobalConfig.HostName)
+	if err != nil {
+		err = errors.Wrap(err, "remove orphan containers error")
+		return
+	}
+	for _, c := range list {
+		if c.Labels[LabelHost] != config.GlobalConfig.HostName || c.Labels[LabelRun] == runID {
+			continue
+		}
+		log.Infof("removing orphan container %s of judging %s", c.ID, c.Labels[LabelJudging])
+		er := d.Sandbox.Remove(ctx, c.ID)
+		if er != nil {
+			log.Error(errors.Wrap(er, "remove orphan containers error"))
+		}
+	}
+	return
+}
@@ -1,25 +1,51 @@
 package controller
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/VOID001/D-judge/config"
-	"github.com/VOID001/D-judge/request"
-	"github.com/docker/engine-api/client"
+	"github.com/VOID001/D-judge/judge-server"
 	"github.com/pkg/errors"
 )
 
+// Exit codes of a DOMjudge style compare script
 const (
 	ExitAC = 42
 	ExitWA = 43
 )
 
-func (w *Worker) judge(ctx context.Context, rank int64, tid int64) (err error) {
+// Exit codes of a testlib checker
+const (
+	TestlibAC = 0
+	TestlibWA = 1
+	TestlibPE = 2
+)
+
+// Checker types, put a checker.type file contains one of them into the
+// compare zip to select, DOMjudge style is the default
+const (
+	CheckerDOMjudge = "domjudge"
+	CheckerTestlib  = "testlib"
+)
+
+// Files the checker writes into the feedback dir, the judge message and diff
+// position are reported as the diff output
+var feedbackFiles = []string{"judgemessage.txt", "diffposition.txt"}
+
+// judge compares the output of the run, res is the result returned by run
+// and it is returned with the verdict
+func (w *Worker) judge(ctx context.Context, tinfo config.TestcaseInfo, res config.RunResult) (result config.RunResult, err error) {
+	rank := tinfo.Rank
 	// Create testcase dir, use to store result
 	execdir := filepath.Join(w.WorkDir, "execdir")
 	testcasedir := filepath.Join(w.WorkDir, fmt.Sprintf("testcase%03d", rank))
@@ -29,27 +55,39 @@ func (w *Worker) judge(ctx context.Context, rank int64, tid int64) (err error) {
 		return
 	}
 	// Build the judge script
-	cli, er := client.NewClient(config.GlobalConfig.DockerServer, config.GlobalConfig.DockerVersion, nil, nil)
-	if er != nil {
-		err = errors.Wrap(er, fmt.Sprintf("Judge error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
+	checker, err := w.checkerType()
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("Judge error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
 		return
 	}
-
-	cmd := fmt.Sprintf("compare/run execdir/testcase.in execdir/testcase.out testcase001 < execdir/program.out 2> compare.err >compare.out")
-	log.Debugf("executing command %s", cmd)
-	info, err := w.execcmdAttach(ctx, cli, "root", cmd)
-	//	time.Sleep(time.Second * 10)
-	code := info.ExitCode
+	var code int
+	if w.JudgeInfo.CombinedRunCompare {
+		// The interactor judged already when running
+		code, err = readInteractorExit(checker, execdir)
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("Judge error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
+			return
+		}
+	} else {
+		args := shellArgs(w.JudgeInfo.CompareArgs)
+		cmd := fmt.Sprintf("compare/run execdir/testcase.in execdir/testcase.out execdir/feedback %s < execdir/program.out 2> compare.err >compare.out", args)
+		if checker == CheckerTestlib {
+			cmd = fmt.Sprintf("compare/run execdir/testcase.in execdir/program.out execdir/testcase.out execdir/feedback/judgemessage.txt %s 2> compare.err >compare.out", args)
+		}
+		log.Debugf("executing command %s", cmd)
+		info, er := w.execcmd(ctx, "root", cmd)
+		if er != nil {
+			err = errors.Wrap(er, fmt.Sprintf("Judge error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
+			return
+		}
+		code = info.ExitCode
+	}
+	res.OutputDiff, err = readFeedback(execdir, filepath.Join(w.WorkDir, "compare.out"))
 	if err != nil {
 		err = errors.Wrap(err, fmt.Sprintf("Judge error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
 		return
 	}
 
-	res := config.RunResult{}
-	res.RunTime = 0 // This is uneccessary
-	res.TestcaseID = tid
-	res.JudgingID = w.JudgeInfo.JudgingID
-
 	// Parse system meta and send to output system
 	// For Domjudge compability
 	// Save for Judge use
@@ -60,29 +98,257 @@ func (w *Worker) judge(ctx context.Context, rank int64, tid int64) (err error) {
 	}
 	res.OutputSystem = fmt.Sprintf("%s", data)
 
-	switch code {
-	case ExitWA:
-		res.RunResult = config.ResWA
-		// Report Accepted
-	case ExitAC:
-		res.RunResult = config.ResAC
-		// Report Wrong Answer
-	default:
-		err = errors.New(fmt.Sprintf("Judge return unexpected exit code %d", code))
+	res.RunResult, err = checkerVerdict(checker, code)
+	if err != nil {
+		// The checker message tells why it fails
+		err = errors.Wrap(err, fmt.Sprintf("Judge error on Run#%d case %d: %s", w.JudgeInfo.SubmitID, rank, res.OutputDiff))
 		return
 	}
+	if res.RunResult == config.ResWA && checker == CheckerDOMjudge && !w.JudgeInfo.CombinedRunCompare {
+		res.RunResult, err = wrongAnswerKind(execdir)
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("Judge error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
+			return
+		}
+	}
+
+	result = res
+	return
+}
 
+// postRun scores and reports the run, the execdir of the run is kept as execdir<rank>
+func (w *Worker) postRun(ctx context.Context, tinfo config.TestcaseInfo, res config.RunResult, sc *scorer) (err error) {
+	execdir := filepath.Join(w.WorkDir, "execdir")
+	ratio, err := scoreRatio(execdir, res.RunResult)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("Judge error on Run#%d case %d", w.JudgeInfo.SubmitID, tinfo.Rank))
+		return
+	}
+	res.Score = ratio * points(tinfo)
+	sc.add(tinfo, res, ratio)
+	err = w.judgeServer.PostRun(ctx, w.JudgeInfo, res)
+	if err != nil {
+		err = errors.Wrap(&server.ServerError{Err: err}, "Judge error")
+		return
+	}
+	w.rank = tinfo.Rank
+	w.saveJournal(StateRun)
 	// Remove execdir for next time use
-	oldexecdir := fmt.Sprintf("%s%03d", execdir, rank)
-	err = request.PostResult(ctx, res)
+	err = os.Rename(execdir, fmt.Sprintf("%s%03d", execdir, tinfo.Rank))
 	if err != nil {
-		err = errors.Wrap(err, "Judge error")
+		err = errors.Wrap(err, fmt.Sprintf("Judge error on Run#%d case %d", w.JudgeInfo.SubmitID, tinfo.Rank))
+		return
+	}
+	return
+}
+
+// checkerType reads the checker type from compare/checker.type
+func (w *Worker) checkerType() (checker string, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(w.WorkDir, "compare", "checker.type"))
+	if os.IsNotExist(err) {
+		checker = CheckerDOMjudge
+		err = nil
 		return
 	}
-	err = os.Rename(execdir, oldexecdir)
 	if err != nil {
-		err = errors.Wrap(err, fmt.Sprintf("Judge error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
+		err = errors.Wrap(err, "read checker type error")
+		return
+	}
+	checker = strings.TrimSpace(string(data))
+	if checker != CheckerDOMjudge && checker != CheckerTestlib {
+		err = &server.ProblemError{Err: errors.New(fmt.Sprintf("unknown checker type %s", checker))}
+		return
+	}
+	return
+}
+
+// checkerVerdict maps the exit code of the checker to the verdict
+func checkerVerdict(checker string, code int) (verdict string, err error) {
+	switch {
+	case checker == CheckerTestlib && code == TestlibAC:
+		verdict = config.ResAC
+	case checker == CheckerTestlib && code == TestlibWA:
+		verdict = config.ResWA
+	case checker == CheckerTestlib && code == TestlibPE:
+		verdict = config.ResPE
+	case checker == CheckerDOMjudge && code == ExitAC:
+		verdict = config.ResAC
+	case checker == CheckerDOMjudge && code == ExitWA:
+		verdict = config.ResWA
+	default:
+		err = &server.ProblemError{Err: errors.New(fmt.Sprintf("%s checker return unexpected exit code %d", checker, code))}
+	}
+	return
+}
+
+// readInteractorExit reads the exit code of the interactor saved by the run
+func readInteractorExit(checker string, execdir string) (code int, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(execdir, "interactor.exit"))
+	if err != nil {
+		err = errors.Wrap(err, "read interactor exit code error")
+		return
+	}
+	code, err = strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		err = errors.Wrap(err, "read interactor exit code error")
+		return
+	}
+	// The interactor gets SIGPIPE when the program exits before the
+	// interaction ends, that is a wrong answer
+	if code == 128+int(syscall.SIGPIPE) {
+		code = ExitWA
+		if checker == CheckerTestlib {
+			code = TestlibWA
+		}
+	}
+	return
+}
+
+// interactorVerdict is the verdict of the interactor of the last run
+func (w *Worker) interactorVerdict(execdir string) (verdict string, err error) {
+	checker, err := w.checkerType()
+	if err != nil {
+		return
+	}
+	code, err := readInteractorExit(checker, execdir)
+	if err != nil {
+		return
+	}
+	verdict, err = checkerVerdict(checker, code)
+	return
+}
+
+// readFeedback collects the messages in the feedback dir, the stdout of the
+// compare script is used for old scripts which write no feedback
+func readFeedback(execdir string, stdout string) (msg string, err error) {
+	for _, f := range feedbackFiles {
+		data, er := ioutil.ReadFile(filepath.Join(execdir, "feedback", f))
+		if os.IsNotExist(er) {
+			continue
+		}
+		if er != nil {
+			err = errors.Wrap(er, "read feedback error")
+			return
+		}
+		msg += string(data)
+	}
+	if msg != "" {
+		return
+	}
+	data, er := ioutil.ReadFile(stdout)
+	if er != nil && !os.IsNotExist(er) {
+		err = errors.Wrap(er, "read feedback error")
+		return
+	}
+	msg = string(data)
+	return
+}
+
+// shellArgs quotes every argument in args, so the compare args from the
+// judge server are passed as they are
+func shellArgs(args string) string {
+	quoted := []string{}
+	for _, arg := range strings.Fields(args) {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes s as one shell word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// wrongAnswerKind tells no-output and presentation error from wrong answer:
+// no output is printed while some is expected, or the output only differs
+// from the answer in whitespace
+func wrongAnswerKind(execdir string) (verdict string, err error) {
+	output := filepath.Join(execdir, "program.out")
+	answer := filepath.Join(execdir, "testcase.out")
+	of, err := os.Stat(output)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	af, err := os.Stat(answer)
+	if err != nil {
 		return
 	}
+	if (of == nil || of.Size() == 0) && af.Size() > 0 {
+		verdict = config.ResNO
+		return
+	}
+	same, err := sameTokens(output, answer)
+	if err != nil {
+		return
+	}
+	verdict = config.ResWA
+	if same {
+		verdict = config.ResPE
+	}
 	return
 }
+
+// sameTokens reports whether the two files are the same when ignoring
+// whitespace. They are compared byte by byte, a token may be of any length
+func sameTokens(a string, b string) (same bool, err error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return
+	}
+	defer fb.Close()
+	ta := &tokenReader{r: bufio.NewReader(fa)}
+	tb := &tokenReader{r: bufio.NewReader(fb)}
+	for {
+		ca, ea := ta.next()
+		cb, eb := tb.next()
+		if ea == io.EOF && eb == io.EOF {
+			same = true
+			return
+		}
+		if ea != nil && ea != io.EOF {
+			err = ea
+			return
+		}
+		if eb != nil && eb != io.EOF {
+			err = eb
+			return
+		}
+		if ea != nil || eb != nil || ca != cb {
+			return
+		}
+	}
+}
+
+// tokenReader reads a file with the whitespace between tokens as one space,
+// and no leading or trailing whitespace
+type tokenReader struct {
+	r       *bufio.Reader
+	started bool
+	space   bool
+}
+
+func (t *tokenReader) next() (c byte, err error) {
+	for {
+		c, err = t.r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r', '\v', '\f':
+			t.space = t.started
+			continue
+		}
+		if t.space {
+			t.space = false
+			t.r.UnreadByte()
+			return ' ', nil
+		}
+		t.started = true
+		return
+	}
+}
@@ -0,0 +1,504 @@
+package controller
+
+// The namespace sandbox, containers without a docker daemon
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// NamespaceSandbox is the Sandbox without a docker daemon, a container is
+// a process tree in its own user, mount, pid, ipc, uts and network
+// namespaces and its own cgroup (v2 only), with the rootfs dir as the root
+// filesystem. So the image of a container is ignored
+type NamespaceSandbox struct {
+	mu       sync.Mutex
+	rootfs   string
+	cgroup   string // Parent cgroup of the containers
+	stateDir string // Containers are recorded here, to find the ones left by a crash
+	seq      int
+	boxes    map[string]*nsBox
+}
+
+// nsBox is a container of the namespace sandbox
+type nsBox struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels"`
+	Cgroup string            `json:"cgroup"`
+	init   *exec.Cmd
+	ctl    *net.UnixConn
+	ready  chan nsMessage
+	exited chan struct{} // Closed when the init exits
+	mu     sync.Mutex
+	seq    int
+	execs  map[string]*nsExecState
+}
+
+type nsExecState struct {
+	done chan struct{} // Closed when the command exits
+	exit int
+	err  string
+}
+
+// NewNamespaceSandbox checks rootfs has what the containers need and
+// enables the controllers of the cgroup dir. The judgehost has to be root,
+// rootless only the judgehost user could be mapped and the program run as
+// it could read the answers and write to the cached files
+func NewNamespaceSandbox(rootfs string, cgroup string, stateDir string) (s *NamespaceSandbox, err error) {
+	if os.Getuid() != 0 {
+		err = errors.New("create namespace sandbox error: the namespace sandbox can not run rootless yet, run the judgehost as root")
+		return
+	}
+	for _, p := range []string{SandboxRoot, "proc", "tmp", "dev", "bin/bash"} {
+		_, err = os.Stat(filepath.Join(rootfs, p))
+		if err != nil {
+			err = errors.Wrap(err, "create namespace sandbox error: bad rootfs")
+			return
+		}
+	}
+	_, err = os.Stat(filepath.Join(CgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		err = errors.Wrap(err, "create namespace sandbox error: cgroup v2 is needed")
+		return
+	}
+	err = os.MkdirAll(cgroup, DirPerm)
+	if err != nil {
+		err = errors.Wrap(err, "create namespace sandbox error")
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(cgroup, "cgroup.subtree_control"), []byte("+cpuset +memory +pids"), FilePerm)
+	if err != nil {
+		err = errors.Wrap(err, "create namespace sandbox error: enable cgroup controllers")
+		return
+	}
+	err = os.MkdirAll(stateDir, DirPerm)
+	if err != nil {
+		err = errors.Wrap(err, "create namespace sandbox error")
+		return
+	}
+	s = &NamespaceSandbox{rootfs: rootfs, cgroup: cgroup, stateDir: stateDir, boxes: make(map[string]*nsBox)}
+	return
+}
+
+// nsIDMappings maps the users of the container as they are
+func nsIDMappings() (uids []syscall.SysProcIDMap, gids []syscall.SysProcIDMap) {
+	return []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 65536}},
+		[]syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 65536}}
+}
+
+func (s *NamespaceSandbox) Create(ctx context.Context, spec ContainerSpec) (id string, err error) {
+	s.mu.Lock()
+	s.seq++
+	id = fmt.Sprintf("ns-%s-%d", runID, s.seq)
+	s.mu.Unlock()
+	b := &nsBox{
+		ID:     id,
+		Labels: spec.Labels,
+		Cgroup: filepath.Join(s.cgroup, id),
+		ready:  make(chan nsMessage, 1),
+		exited: make(chan struct{}),
+		execs:  make(map[string]*nsExecState),
+	}
+	err = s.start(ctx, b, spec)
+	if err != nil {
+		s.destroy(b)
+		err = errors.Wrap(err, "create container error")
+		return
+	}
+	s.mu.Lock()
+	s.boxes[id] = b
+	s.mu.Unlock()
+	return
+}
+
+// start creates the cgroup of the container and starts its init in it
+func (s *NamespaceSandbox) start(ctx context.Context, b *nsBox, spec ContainerSpec) (err error) {
+	err = os.Mkdir(b.Cgroup, DirPerm)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(s.stateDir, b.ID+".json"), data, FilePerm)
+	if err != nil {
+		return
+	}
+	limits := [][2]string{
+		{"cpuset.cpus", strconv.Itoa(spec.CPU)},
+		{"memory.max", cgroupLimit(spec.Memory)},
+		{"memory.swap.max", "0"},
+		{"pids.max", cgroupLimit(spec.Pids)},
+	}
+	for _, l := range limits {
+		err = ioutil.WriteFile(filepath.Join(b.Cgroup, l[0]), []byte(l[1]), FilePerm)
+		if err != nil {
+			return
+		}
+	}
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	parent := os.NewFile(uintptr(fds[0]), "ctl")
+	child := os.NewFile(uintptr(fds[1]), "ctl")
+	defer child.Close()
+	c, err := net.FileConn(parent)
+	parent.Close()
+	if err != nil {
+		return
+	}
+	b.ctl = c.(*net.UnixConn)
+	seccomp, err := lookupSyscalls(spec.Seccomp)
+	if err != nil {
+		return
+	}
+	caps, err := lookupCaps(spec.Caps)
+	if err != nil {
+		return
+	}
+	cfg, err := json.Marshal(nsInitConfig{Rootfs: s.rootfs, Dir: spec.Dir, Seccomp: seccomp, Caps: caps})
+	if err != nil {
+		return
+	}
+	uids, gids := nsIDMappings()
+	b.init = exec.Command("/proc/self/exe")
+	b.init.Args = []string{"sandbox-init"}
+	b.init.Env = []string{nsInitEnv + "=" + string(cfg)}
+	b.init.ExtraFiles = []*os.File{child} // nsCtlFd
+	b.init.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS | syscall.CLONE_NEWNET,
+		UidMappings: uids,
+		GidMappings: gids,
+	}
+	err = b.init.Start()
+	if err != nil {
+		return
+	}
+	go func() {
+		b.init.Wait()
+		close(b.exited)
+	}()
+	go b.read()
+	err = ioutil.WriteFile(filepath.Join(b.Cgroup, "cgroup.procs"), []byte(strconv.Itoa(b.init.Process.Pid)), FilePerm)
+	if err != nil {
+		return
+	}
+	err = nsSend(b.ctl, nsMessage{}, nil)
+	if err != nil {
+		return
+	}
+	select {
+	case msg := <-b.ready:
+		if msg.Error != "" {
+			err = errors.New(msg.Error)
+		}
+	case <-b.exited:
+		err = errors.New("sandbox init exited")
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// read receives the messages of the init until it exits
+func (b *nsBox) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, _, _, err := b.ctl.ReadMsgUnix(buf, nil)
+		if err != nil || n == 0 {
+			return
+		}
+		msg := nsMessage{}
+		err = json.Unmarshal(buf[:n], &msg)
+		if err != nil {
+			log.Warn(errors.Wrap(err, "read sandbox message error"))
+			continue
+		}
+		if msg.ID == "" {
+			b.ready <- msg
+			continue
+		}
+		b.mu.Lock()
+		e := b.execs[msg.ID]
+		b.mu.Unlock()
+		if e == nil {
+			continue
+		}
+		e.exit = msg.Exit
+		e.err = msg.Error
+		close(e.done)
+	}
+}
+
+// cgroupLimit formats lim for a cgroup v2 limit file, 0 for no limit
+func cgroupLimit(lim int64) string {
+	if lim <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(lim, 10)
+}
+
+func (s *NamespaceSandbox) box(id string) (b *nsBox, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.boxes[id]
+	if !ok {
+		err = errors.New(fmt.Sprintf("no such container %s", id))
+	}
+	return
+}
+
+func (s *NamespaceSandbox) Exec(ctx context.Context, id string, user string, cmd string) (execID string, output io.ReadCloser, err error) {
+	b, err := s.box(id)
+	if err != nil {
+		err = errors.Wrap(err, "exec command in container error")
+		return
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		err = errors.Wrap(err, "exec command in container error")
+		return
+	}
+	out := os.NewFile(uintptr(fds[0]), "output")
+	in := os.NewFile(uintptr(fds[1]), "output")
+	defer in.Close()
+	b.mu.Lock()
+	b.seq++
+	execID = fmt.Sprintf("%s/%d", id, b.seq)
+	b.execs[execID] = &nsExecState{done: make(chan struct{})}
+	b.mu.Unlock()
+	err = nsSend(b.ctl, nsMessage{ID: execID, User: user, Cmd: cmd}, in)
+	if err != nil {
+		out.Close()
+		err = errors.Wrap(err, "exec command in container error")
+		return
+	}
+	output = out
+	return
+}
+
+// ExecInspect waits for the command to exit, as it is only asked for after
+// the output ends and the exit may come a bit later
+func (s *NamespaceSandbox) ExecInspect(ctx context.Context, execID string) (info ExecInfo, err error) {
+	id := execID
+	if i := strings.LastIndex(execID, "/"); i >= 0 {
+		id = execID[:i]
+	}
+	b, err := s.box(id)
+	if err != nil {
+		err = errors.Wrap(err, "inspect exec error")
+		return
+	}
+	b.mu.Lock()
+	e := b.execs[execID]
+	b.mu.Unlock()
+	if e == nil {
+		err = errors.New(fmt.Sprintf("inspect exec error: no such exec %s", execID))
+		return
+	}
+	select {
+	case <-e.done:
+	case <-b.exited:
+		err = errors.New("inspect exec error: container stopped")
+		return
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "inspect exec error")
+		return
+	}
+	if e.err != "" {
+		err = errors.New(fmt.Sprintf("inspect exec error: %s", e.err))
+		return
+	}
+	info.ExitCode = e.exit
+	return
+}
+
+func (s *NamespaceSandbox) Inspect(ctx context.Context, id string) (state ContainerState, err error) {
+	b, err := s.box(id)
+	if err != nil {
+		err = errors.Wrap(err, "inspect container error")
+		return
+	}
+	select {
+	case <-b.exited:
+	default:
+		state.Running = true
+	}
+	state.Pid = b.init.Process.Pid
+	return
+}
+
+func (s *NamespaceSandbox) SetMemory(ctx context.Context, id string, lim int64) (err error) {
+	b, err := s.box(id)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("set memory limit to %d error", lim))
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(b.Cgroup, "memory.max"), []byte(cgroupLimit(lim)), FilePerm)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("set memory limit to %d error", lim))
+		return
+	}
+	return
+}
+
+// Stop kills the init, the kernel kills the rest of the pid namespace
+func (s *NamespaceSandbox) Stop(ctx context.Context, id string) (err error) {
+	b, err := s.box(id)
+	if err != nil {
+		err = errors.Wrap(err, "stop container error")
+		return
+	}
+	b.init.Process.Kill()
+	select {
+	case <-b.exited:
+	case <-ctx.Done():
+		err = errors.Wrap(ctx.Err(), "stop container error")
+		return
+	}
+	return
+}
+
+// Remove removes the container, the ones left by an earlier run are
+// found in the state dir
+func (s *NamespaceSandbox) Remove(ctx context.Context, id string) (err error) {
+	s.mu.Lock()
+	b, ok := s.boxes[id]
+	delete(s.boxes, id)
+	s.mu.Unlock()
+	if !ok {
+		data, er := ioutil.ReadFile(filepath.Join(s.stateDir, id+".json"))
+		if er != nil {
+			err = errors.Wrap(er, "remove container error")
+			return
+		}
+		b = &nsBox{}
+		err = json.Unmarshal(data, b)
+		if err != nil {
+			err = errors.Wrap(err, "remove container error")
+			return
+		}
+	}
+	err = s.destroy(b)
+	if err != nil {
+		err = errors.Wrap(err, "remove container error")
+		return
+	}
+	return
+}
+
+// destroy kills everything in the cgroup of the container and removes it
+func (s *NamespaceSandbox) destroy(b *nsBox) (err error) {
+	if b.init != nil && b.init.Process != nil {
+		b.init.Process.Kill()
+		<-b.exited
+	}
+	if b.ctl != nil {
+		b.ctl.Close()
+	}
+	// cgroup.kill is there since linux 5.14
+	er := ioutil.WriteFile(filepath.Join(b.Cgroup, "cgroup.kill"), []byte("1"), FilePerm)
+	if er != nil && !os.IsNotExist(er) {
+		pids, _ := cgroupPids(b.Cgroup)
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	// The cgroup and the children made by openCgroup can be removed once
+	// the killed processes are gone
+	err = removeCgroup(b.Cgroup)
+	if err != nil {
+		return
+	}
+	err = os.Remove(filepath.Join(s.stateDir, b.ID+".json"))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+func (s *NamespaceSandbox) List(ctx context.Context, label string, value string) (list []ContainerInfo, err error) {
+	files, err := ioutil.ReadDir(s.stateDir)
+	if err != nil {
+		err = errors.Wrap(err, "list containers error")
+		return
+	}
+	for _, f := range files {
+		data, er := ioutil.ReadFile(filepath.Join(s.stateDir, f.Name()))
+		if er != nil {
+			continue
+		}
+		b := nsBox{}
+		er = json.Unmarshal(data, &b)
+		if er != nil || b.Labels[label] != value {
+			continue
+		}
+		list = append(list, ContainerInfo{ID: b.ID, Labels: b.Labels})
+	}
+	return
+}
+
+// Changes returns what is in /tmp, the only writable dir of the container
+// other than SandboxRoot
+func (s *NamespaceSandbox) Changes(ctx context.Context, id string) (changes map[string]bool, err error) {
+	b, err := s.box(id)
+	if err != nil {
+		err = errors.Wrap(err, "diff container error")
+		return
+	}
+	root := fmt.Sprintf("/proc/%d/root", b.init.Process.Pid)
+	changes = make(map[string]bool)
+	err = filepath.Walk(filepath.Join(root, "tmp"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		path = strings.TrimPrefix(path, root)
+		if path != "/tmp" {
+			changes["1 "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		err = errors.Wrap(err, "diff container error")
+		return
+	}
+	return
+}
+
+func (s *NamespaceSandbox) Processes(ctx context.Context, id string) (n int, err error) {
+	b, err := s.box(id)
+	if err != nil {
+		err = errors.Wrap(err, "list processes error")
+		return
+	}
+	pids, err := cgroupPids(b.Cgroup)
+	if err != nil {
+		err = errors.Wrap(err, "list processes error")
+		return
+	}
+	n = len(pids)
+	return
+}
+
+// Healthy is always true, there is no daemon to lose
+func (s *NamespaceSandbox) Healthy() (healthy bool, err error) {
+	return true, nil
+}
@@ -0,0 +1,423 @@
+package controller
+
+// The init and the exec helper of the namespace sandbox. The judgehost
+// re-executes itself in new namespaces as the init of a container, which
+// sets up the root filesystem and runs the commands sent by the judgehost.
+// A command is run by re-executing once more as the exec helper, which
+// switches to the user, installs the seccomp filter and execs /bin/bash
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	nsInitEnv = "D_JUDGE_SANDBOX_INIT"
+	nsExecEnv = "D_JUDGE_SANDBOX_EXEC"
+	nsCtlFd   = 3 // Control socket of the init, a unix seqpacket socket to the judgehost
+)
+
+// nsDevices are bound from the host into the /dev of the container
+var nsDevices = []string{"null", "zero", "full", "random", "urandom"}
+
+// nsEnv is the environment of the commands
+var nsEnv = []string{
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"HOME=/tmp",
+	"LANG=C.UTF-8",
+}
+
+// nsInitConfig is passed to the init in nsInitEnv
+type nsInitConfig struct {
+	Rootfs  string    `json:"rootfs"`
+	Dir     string    `json:"dir"` // Bound to SandboxRoot
+	Seccomp []uintptr `json:"seccomp"`
+	Caps    []uintptr `json:"caps"`
+}
+
+// nsExecConfig is passed to the exec helper in nsExecEnv
+type nsExecConfig struct {
+	User    string    `json:"user"`
+	Cmd     string    `json:"cmd"`
+	Seccomp []uintptr `json:"seccomp"` // Denied syscalls
+	Caps    []uintptr `json:"caps"`    // Capabilities kept
+}
+
+// nsMessage is sent over the control socket. The judgehost sends ID, User
+// and Cmd with the output socket attached to run a command, the init
+// answers ID and Exit when it exits. An empty ID is the setup: the
+// judgehost sends it when the init is in the cgroup, the init answers it
+// when the root filesystem is ready, with Error if it is not
+type nsMessage struct {
+	ID    string `json:"id,omitempty"`
+	User  string `json:"user,omitempty"`
+	Cmd   string `json:"cmd,omitempty"`
+	Exit  int    `json:"exit"`
+	Error string `json:"error,omitempty"`
+}
+
+// Runs before anything else of the judgehost, like flags and config
+func init() {
+	if data := os.Getenv(nsInitEnv); data != "" {
+		nsInit(data)
+		os.Exit(0)
+	}
+	if data := os.Getenv(nsExecEnv); data != "" {
+		err := nsExec(data)
+		fmt.Fprintf(os.Stderr, "sandbox exec error: %s\n", err)
+		os.Exit(126)
+	}
+}
+
+// nsInit is the init of a container, it returns when the judgehost is gone
+// and everything in the container is killed with it
+func nsInit(data string) {
+	f := os.NewFile(nsCtlFd, "ctl")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return
+	}
+	ctl := c.(*net.UnixConn)
+	defer ctl.Close()
+	// Wait until the judgehost moves the init into the cgroup
+	_, _, _, _, err = ctl.ReadMsgUnix(make([]byte, 4096), nil)
+	if err != nil {
+		return
+	}
+	cfg := nsInitConfig{}
+	err = json.Unmarshal([]byte(data), &cfg)
+	if err == nil {
+		err = nsSetupRoot(cfg)
+	}
+	reply := nsMessage{}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	nsSend(ctl, reply, nil)
+	if err != nil {
+		return
+	}
+	nsServe(ctl, cfg)
+}
+
+// nsSetupRoot makes cfg.Rootfs the read-only root with cfg.Dir at
+// SandboxRoot, and a fresh /proc, /tmp and /dev
+func nsSetupRoot(cfg nsInitConfig) (err error) {
+	root := cfg.Rootfs
+	mounts := []struct {
+		source string
+		target string
+		fstype string
+		flags  uintptr
+		data   string
+	}{
+		{"", "/", "", unix.MS_REC | unix.MS_PRIVATE, ""},
+		{root, root, "", unix.MS_BIND | unix.MS_REC, ""},
+		{cfg.Dir, filepath.Join(root, SandboxRoot), "", unix.MS_BIND | unix.MS_REC, ""},
+		{"proc", filepath.Join(root, "proc"), "proc", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+		{"tmpfs", filepath.Join(root, "tmp"), "tmpfs", unix.MS_NOSUID | unix.MS_NODEV, "mode=755"},
+		{"tmpfs", filepath.Join(root, "dev"), "tmpfs", unix.MS_NOSUID | unix.MS_NOEXEC, "mode=755"},
+	}
+	for _, m := range mounts {
+		err = unix.Mount(m.source, m.target, m.fstype, m.flags, m.data)
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("setup root error: mount %s", m.target))
+			return
+		}
+	}
+	for _, d := range nsDevices {
+		target := filepath.Join(root, "dev", d)
+		err = ioutil.WriteFile(target, nil, FilePerm)
+		if err != nil {
+			err = errors.Wrap(err, "setup root error")
+			return
+		}
+		err = unix.Mount(filepath.Join("/dev", d), target, "", unix.MS_BIND, "")
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("setup root error: mount %s", target))
+			return
+		}
+	}
+	links := map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2"}
+	for name, target := range links {
+		err = os.Symlink(target, filepath.Join(root, "dev", name))
+		if err != nil {
+			err = errors.Wrap(err, "setup root error")
+			return
+		}
+	}
+	// Stack the new root on the old one, then detach the old one
+	err = unix.Chdir(root)
+	if err == nil {
+		err = unix.PivotRoot(".", ".")
+	}
+	if err == nil {
+		err = unix.Unmount(".", unix.MNT_DETACH)
+	}
+	if err == nil {
+		err = unix.Chdir("/")
+	}
+	if err != nil {
+		err = errors.Wrap(err, "setup root error: pivot root")
+		return
+	}
+	// The flags locked by the mount of the host must be kept
+	st := unix.Statfs_t{}
+	err = unix.Statfs("/", &st)
+	if err != nil {
+		err = errors.Wrap(err, "setup root error")
+		return
+	}
+	flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+	locked := map[int64]uintptr{
+		unix.ST_NOSUID:     unix.MS_NOSUID,
+		unix.ST_NODEV:      unix.MS_NODEV,
+		unix.ST_NOEXEC:     unix.MS_NOEXEC,
+		unix.ST_NOATIME:    unix.MS_NOATIME,
+		unix.ST_NODIRATIME: unix.MS_NODIRATIME,
+		unix.ST_RELATIME:   unix.MS_RELATIME,
+	}
+	for stFlag, ms := range locked {
+		if st.Flags&stFlag != 0 {
+			flags |= ms
+		}
+	}
+	err = unix.Mount("", "/", "", flags, "")
+	if err != nil {
+		err = errors.Wrap(err, "setup root error: remount root read-only")
+		return
+	}
+	err = unix.Sethostname([]byte("sandbox"))
+	if err != nil {
+		err = errors.Wrap(err, "setup root error")
+		return
+	}
+	err = unix.Chdir(SandboxRoot)
+	if err != nil {
+		err = errors.Wrap(err, "setup root error")
+		return
+	}
+	return
+}
+
+// nsReaper reaps all processes in the container, as the init has to, and
+// reports the exit of the commands
+type nsReaper struct {
+	cfg     nsInitConfig
+	mu      sync.Mutex
+	execs   map[int]string // ID of the command of the pid
+	started chan struct{}
+}
+
+// nsServe runs the commands sent by the judgehost until it is gone
+func nsServe(ctl *net.UnixConn, cfg nsInitConfig) {
+	r := &nsReaper{cfg: cfg, execs: make(map[int]string), started: make(chan struct{}, 1)}
+	go r.reap(ctl)
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, unix.CmsgSpace(4))
+	for {
+		n, oobn, _, _, err := ctl.ReadMsgUnix(buf, oob)
+		if err != nil || n == 0 {
+			return
+		}
+		msg := nsMessage{}
+		err = json.Unmarshal(buf[:n], &msg)
+		if err != nil {
+			continue
+		}
+		out, err := nsRights(oob[:oobn])
+		if err == nil {
+			err = r.start(msg, out)
+			out.Close()
+		}
+		if err != nil {
+			nsSend(ctl, nsMessage{ID: msg.ID, Exit: 127, Error: err.Error()}, nil)
+		}
+	}
+}
+
+// start starts the exec helper of the command, its output goes to out
+func (r *nsReaper) start(msg nsMessage, out *os.File) (err error) {
+	data, err := json.Marshal(nsExecConfig{User: msg.User, Cmd: msg.Cmd, Seccomp: r.cfg.Seccomp, Caps: r.cfg.Caps})
+	if err != nil {
+		err = errors.Wrap(err, "start command error")
+		return
+	}
+	null, err := os.Open("/dev/null")
+	if err != nil {
+		err = errors.Wrap(err, "start command error")
+		return
+	}
+	defer null.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	attr := &os.ProcAttr{
+		Dir:   SandboxRoot,
+		Env:   []string{nsExecEnv + "=" + string(data)},
+		Files: []*os.File{null, out, out},
+	}
+	p, err := os.StartProcess("/proc/self/exe", []string{"sandbox-exec"}, attr)
+	if err != nil {
+		err = errors.Wrap(err, "start command error")
+		return
+	}
+	r.execs[p.Pid] = msg.ID
+	p.Release()
+	select {
+	case r.started <- struct{}{}:
+	default:
+	}
+	return
+}
+
+func (r *nsReaper) reap(ctl *net.UnixConn) {
+	for {
+		ws := unix.WaitStatus(0)
+		pid, err := unix.Wait4(-1, &ws, 0, nil)
+		if err == unix.ECHILD {
+			<-r.started
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		r.mu.Lock()
+		id, ok := r.execs[pid]
+		delete(r.execs, pid)
+		r.mu.Unlock()
+		// Orphans of the commands end up here too
+		if !ok {
+			continue
+		}
+		code := ws.ExitStatus()
+		if ws.Signaled() {
+			code = 128 + int(ws.Signal())
+		}
+		nsSend(ctl, nsMessage{ID: id, Exit: code}, nil)
+	}
+}
+
+// nsSend sends msg over the control socket, with f attached if not nil
+func nsSend(ctl *net.UnixConn, msg nsMessage, f *os.File) (err error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		err = errors.Wrap(err, "send message error")
+		return
+	}
+	var oob []byte
+	if f != nil {
+		oob = unix.UnixRights(int(f.Fd()))
+	}
+	_, _, err = ctl.WriteMsgUnix(data, oob, nil)
+	if err != nil {
+		err = errors.Wrap(err, "send message error")
+		return
+	}
+	return
+}
+
+// nsRights returns the file attached to the message
+func nsRights(oob []byte) (f *os.File, err error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		err = errors.Wrap(err, "receive file error")
+		return
+	}
+	var fds []int
+	for _, m := range msgs {
+		rights, er := unix.ParseUnixRights(&m)
+		if er == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		err = errors.New(fmt.Sprintf("receive file error: %d files attached", len(fds)))
+		return
+	}
+	f = os.NewFile(uintptr(fds[0]), "output")
+	return
+}
+
+// nsExec becomes the command, it only returns on error
+func nsExec(data string) (err error) {
+	cfg := nsExecConfig{}
+	err = json.Unmarshal([]byte(data), &cfg)
+	if err != nil {
+		return
+	}
+	// The filter and no_new_privs are set on this thread, which execs
+	runtime.LockOSThread()
+	err = dropCaps(cfg.Caps)
+	if err != nil {
+		return
+	}
+	if cfg.User != "" && cfg.User != "root" {
+		uid, gid, er := lookupUser("/etc/passwd", cfg.User)
+		if er != nil {
+			return er
+		}
+		err = syscall.Setgroups([]int{gid})
+		if err == nil {
+			err = syscall.Setgid(gid)
+		}
+		if err == nil {
+			err = syscall.Setuid(uid)
+		}
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("switch to user %s error", cfg.User))
+			return
+		}
+	}
+	prog, err := seccompFilter(cfg.Seccomp)
+	if err != nil {
+		return
+	}
+	err = installSeccomp(prog)
+	if err != nil {
+		return
+	}
+	err = unix.Exec("/bin/bash", []string{"/bin/bash", "-c", cfg.Cmd}, nsEnv)
+	return
+}
+
+// lookupUser finds the uid and gid of the user in the passwd file
+func lookupUser(passwd string, name string) (uid int, gid int, err error) {
+	data, err := ioutil.ReadFile(passwd)
+	if err != nil {
+		err = errors.Wrap(err, "lookup user error")
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 || fields[0] != name {
+			continue
+		}
+		uid, err = strconv.Atoi(fields[2])
+		if err == nil {
+			gid, err = strconv.Atoi(fields[3])
+		}
+		if err != nil {
+			err = errors.Wrap(err, "lookup user error")
+		}
+		return
+	}
+	err = errors.New(fmt.Sprintf("lookup user error: no user %s", name))
+	return
+}
@@ -0,0 +1,122 @@
+package controller
+
+// Worker pools, the workers of a pool share the cores and resource profile
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/VOID001/D-judge/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultPidsLimit = 64  // Enough for almost all case
+	PoolQueueSize    = 100 // Judgings routed to a busy pool wait here
+)
+
+type pool struct {
+	config.PoolConfig
+	cpus   *CPUAllocator
+	queue  chan Worker
+	slot   int // Index of the first worker of the pool in Daemon.WorkerState
+	busy   int
+	queued int
+}
+
+// newPools creates the pools, pools may not share a physical core
+func newPools(cfgs []config.PoolConfig) (pools []*pool, err error) {
+	owner := make(map[int]string) // Pool owning the cpu
+	slot := 0
+	for i, c := range cfgs {
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("pool%d", i)
+		}
+		cpus, er := NewCPUAllocator(c.CPUs, config.GlobalConfig.ReservedCPUs)
+		if er != nil {
+			err = errors.Wrap(er, fmt.Sprintf("create pool %s error", c.Name))
+			return
+		}
+		for _, core := range cpus.cores {
+			siblings, er := cpuSiblings(core)
+			if er != nil {
+				err = errors.Wrap(er, fmt.Sprintf("create pool %s error", c.Name))
+				return
+			}
+			for _, s := range siblings {
+				if o, ok := owner[s]; ok {
+					err = errors.New(fmt.Sprintf("create pool %s error: cpu %d is used by pool %s too", c.Name, s, o))
+					return
+				}
+				owner[s] = c.Name
+			}
+		}
+		if c.Workers <= 0 {
+			c.Workers = cpus.Len()
+		}
+		if c.Workers > cpus.Len() {
+			err = errors.New(fmt.Sprintf("create pool %s error: %d workers but only %d cores", c.Name, c.Workers, cpus.Len()))
+			return
+		}
+		pools = append(pools, &pool{PoolConfig: c, cpus: cpus, queue: make(chan Worker, PoolQueueSize), slot: slot})
+		slot += c.Workers
+	}
+	return
+}
+
+// profile applies the resource profile of the pool to the worker
+func (p *pool) profile(w *Worker) {
+	if p.RootMemory > 0 {
+		w.rootMemory = p.RootMemory
+	}
+	if p.PidsLimit > 0 {
+		w.pidsLimit = p.PidsLimit
+	}
+	if p.DockerImage != "" {
+		w.DockerImage = p.DockerImage
+	}
+}
+
+// free returns the number of workers of the pool neither judging nor
+// having a task queued, d.stateMu should be held
+func (p *pool) free() int {
+	if n := p.Workers - p.busy - p.queued; n > 0 {
+		return n
+	}
+	return 0
+}
+
+// lowest returns the lowest MinTimeLimit of the pools, every judging fits
+// the pools with it
+func (d *Daemon) lowest() (min float64) {
+	for i, p := range d.pools {
+		if i == 0 || p.MinTimeLimit < min {
+			min = p.MinTimeLimit
+		}
+	}
+	return
+}
+
+// route picks the pool with the highest MinTimeLimit not above the time
+// limit of the judging (the lowest MinTimeLimit if none is) having a free
+// worker, or the one with the highest if all are busy. d.stateMu should be
+// held
+func (d *Daemon) route(jinfo config.JudgeInfo) (p *pool) {
+	tl := math.Max(jinfo.TimeLimit, d.lowest())
+	var free *pool
+	for _, q := range d.pools {
+		if q.MinTimeLimit > tl {
+			continue
+		}
+		if p == nil || q.MinTimeLimit > p.MinTimeLimit {
+			p = q
+		}
+		if q.free() > 0 && (free == nil || q.MinTimeLimit > free.MinTimeLimit) {
+			free = q
+		}
+	}
+	if free != nil {
+		p = free
+	}
+	return
+}
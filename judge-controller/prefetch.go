@@ -0,0 +1,163 @@
+package controller
+
+// Testcase prefetching, the files of all testcases of a judging are
+// downloaded by a few goroutines while the submission is built, so the
+// testcase loop need not wait for the judge server between runs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/VOID001/D-judge/config"
+	"github.com/VOID001/D-judge/judge-server"
+	"github.com/pkg/errors"
+)
+
+// PrefetchDirSuffix is appended to the work dir of the judging to get the
+// prefetch dir. It is not in the work dir as the work dir is moved into the
+// warm container while building
+const PrefetchDirSuffix = ".testcases"
+
+// prefetcher downloads the testcase files of a judging into dir
+type prefetcher struct {
+	dir    string
+	files  map[int64]*prefetchFiles // By testcase ID
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// prefetchFiles are the input and output of one testcase, done is closed
+// when both are downloaded or failed
+type prefetchFiles struct {
+	input  string
+	output string
+	done   chan struct{}
+	err    error
+}
+
+// startPrefetch starts downloading the testcases of the judging with
+// prefetch_workers downloads at a time. Nothing is prefetched if it is 0
+// or the server does not list the testcases, they are downloaded before
+// each run then
+func (w *Worker) startPrefetch(ctx context.Context) {
+	n := config.GlobalConfig.PrefetchWorkers
+	if n <= 0 {
+		return
+	}
+	tinfos, ok, err := w.judgeServer.ListTestcases(ctx, w.JudgeInfo)
+	if err != nil {
+		log.Warnf("list testcases of judging %d failed, not prefetching: %s", w.JudgeInfo.JudgingID, err)
+		return
+	}
+	if !ok || len(tinfos) == 0 {
+		return
+	}
+	dir := w.WorkDir + PrefetchDirSuffix
+	os.RemoveAll(dir)
+	err = os.MkdirAll(dir, DirPerm)
+	if err != nil {
+		log.Warnf("create prefetch dir failed, not prefetching: %s", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	p := &prefetcher{dir: dir, files: make(map[int64]*prefetchFiles), cancel: cancel}
+	js := w.judgeServer
+	sem := make(chan struct{}, n)
+	for _, tinfo := range tinfos {
+		f := &prefetchFiles{
+			input:  filepath.Join(dir, fmt.Sprintf("testcase%03d.in", tinfo.Rank)),
+			output: filepath.Join(dir, fmt.Sprintf("testcase%03d.out", tinfo.Rank)),
+			done:   make(chan struct{}),
+		}
+		p.files[tinfo.TestcaseID] = f
+		p.wg.Add(1)
+		go func(tinfo config.TestcaseInfo) {
+			defer p.wg.Done()
+			defer close(f.done)
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				f.err = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+			f.err = js.FetchTestcaseFile(ctx, tinfo, server.TestcaseInput, f.input)
+			if f.err == nil {
+				f.err = js.FetchTestcaseFile(ctx, tinfo, server.TestcaseOutput, f.output)
+			}
+			if f.err != nil {
+				log.Debugf("prefetch testcase %d failed: %s", tinfo.Rank, f.err)
+			}
+		}(tinfo)
+	}
+	w.prefetch = p
+	log.Debugf("prefetching %d testcases of judging %d", len(tinfos), w.JudgeInfo.JudgingID)
+}
+
+// stopPrefetch cancels the downloads in progress and removes the prefetch dir
+func (w *Worker) stopPrefetch() {
+	p := w.prefetch
+	if p == nil {
+		return
+	}
+	w.prefetch = nil
+	p.cancel()
+	p.wg.Wait()
+	os.RemoveAll(p.dir)
+}
+
+// fetchTestcase puts the input and output of the testcase into the work
+// dir. A prefetched testcase is waited for and linked, the testcase is
+// downloaded now if it is not prefetched or the prefetch failed
+func (w *Worker) fetchTestcase(ctx context.Context, tinfo config.TestcaseInfo) (err error) {
+	input := filepath.Join(w.WorkDir, fmt.Sprintf("testcase%03d.in", tinfo.Rank))
+	output := filepath.Join(w.WorkDir, fmt.Sprintf("testcase%03d.out", tinfo.Rank))
+	if w.prefetch != nil {
+		if f, ok := w.prefetch.files[tinfo.TestcaseID]; ok {
+			select {
+			case <-f.done:
+			case <-ctx.Done():
+				err = errors.Wrap(ctx.Err(), "fetch testcase error")
+				return
+			}
+			if f.err == nil {
+				f.err = linkFile(f.input, input)
+			}
+			if f.err == nil {
+				f.err = linkFile(f.output, output)
+			}
+			if f.err == nil {
+				return
+			}
+			log.Warnf("prefetch testcase %d failed, download it again: %s", tinfo.Rank, f.err)
+		}
+	}
+
+	err = w.judgeServer.FetchTestcaseFile(ctx, tinfo, server.TestcaseInput, input)
+	if err != nil {
+		err = errors.Wrap(&server.ServerError{Err: err}, "fetch testcase error")
+		return
+	}
+	err = w.judgeServer.FetchTestcaseFile(ctx, tinfo, server.TestcaseOutput, output)
+	if err != nil {
+		err = errors.Wrap(&server.ServerError{Err: err}, "fetch testcase error")
+		return
+	}
+	return
+}
+
+// linkFile links src to dest, replacing dest
+func linkFile(src string, dest string) (err error) {
+	os.Remove(dest)
+	err = os.Link(src, dest)
+	if err != nil {
+		err = errors.Wrap(err, "link file error")
+		return
+	}
+	return
+}
@@ -2,12 +2,11 @@ package controller
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"path/filepath"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/VOID001/D-judge/downloader"
+	"github.com/VOID001/D-judge/judge-server"
 	"github.com/pkg/errors"
 )
 
@@ -22,20 +21,11 @@ func (w *Worker) prepare(ctx context.Context) (err error) {
 	}
 
 	// Get the code first
-	d := downloader.Downloader{
-		FileType:     "code",
-		Destination:  filepath.Join(w.WorkDir, "foo"), // Here just provide a dummy destination, it will correct when call downloader
-		FileName:     filepath.Join(w.WorkDir, "foo"), // Here just provide a dummy filename, it will correct when call downloader
-		SkipMD5Check: true,
-		UseCache:     false,
-		Params:       []string{fmt.Sprintf("%d", w.JudgeInfo.SubmitID)},
-	}
-	err = d.Do(ctx)
+	w.codeFileName, err = w.judgeServer.FetchSubmission(ctx, w.JudgeInfo, w.WorkDir)
 	if err != nil {
-		err = errors.Wrap(err, "error preparing for judge")
+		err = errors.Wrap(&server.ServerError{Err: err}, "error preparing for judge")
 		return
 	}
-	w.codeFileName = d.FileName
 
 	// Get the build & run script then
 	rundir := filepath.Join(w.WorkDir, "run")
@@ -45,18 +35,9 @@ func (w *Worker) prepare(ctx context.Context) (err error) {
 		return
 	}
 
-	d = downloader.Downloader{
-		FileType:     "executable",
-		FileName:     w.JudgeInfo.RunZip,
-		Destination:  filepath.Join(rundir, w.JudgeInfo.RunZip),
-		SkipMD5Check: false,
-		MD5:          w.JudgeInfo.RunZipMD5,
-		UseCache:     true,
-		Params:       []string{w.JudgeInfo.RunZip},
-	}
-	err = d.Do(ctx)
+	err = w.judgeServer.FetchExecutable(ctx, w.JudgeInfo.RunZip, w.JudgeInfo.RunZipMD5, filepath.Join(rundir, w.JudgeInfo.RunZip))
 	if err != nil {
-		err = errors.Wrap(err, "error preparing for judge")
+		err = errors.Wrap(&server.ServerError{Err: err}, "error preparing for judge")
 		return
 	}
 
@@ -67,14 +48,9 @@ func (w *Worker) prepare(ctx context.Context) (err error) {
 		return
 	}
 
-	d.FileName = w.JudgeInfo.BuildZip
-	d.Destination = filepath.Join(builddir, w.JudgeInfo.BuildZip)
-	d.MD5 = w.JudgeInfo.BuildZipMD5
-	d.Params = []string{w.JudgeInfo.BuildZip}
-	err = d.Do(ctx)
-
+	err = w.judgeServer.FetchExecutable(ctx, w.JudgeInfo.BuildZip, w.JudgeInfo.BuildZipMD5, filepath.Join(builddir, w.JudgeInfo.BuildZip))
 	if err != nil {
-		err = errors.Wrap(err, "error preparing for judge")
+		err = errors.Wrap(&server.ServerError{Err: err}, "error preparing for judge")
 		return
 	}
 
@@ -84,14 +60,10 @@ func (w *Worker) prepare(ctx context.Context) (err error) {
 		err = errors.Wrap(err, "error preparing for judge")
 		return
 	}
-	d.FileName = w.JudgeInfo.CompareZip
-	d.Destination = filepath.Join(comparedir, w.JudgeInfo.CompareZip)
-	d.MD5 = w.JudgeInfo.CompareZipMD5
-	d.Params = []string{w.JudgeInfo.CompareZip}
 
-	err = d.Do(ctx)
+	err = w.judgeServer.FetchExecutable(ctx, w.JudgeInfo.CompareZip, w.JudgeInfo.CompareZipMD5, filepath.Join(comparedir, w.JudgeInfo.CompareZip))
 	if err != nil {
-		err = errors.Wrap(err, "error preparing for judge")
+		err = errors.Wrap(&server.ServerError{Err: err}, "error preparing for judge")
 		return
 	}
 
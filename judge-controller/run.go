@@ -6,24 +6,26 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/VOID001/D-judge/config"
-	"github.com/VOID001/D-judge/request"
-	"github.com/docker/engine-api/client"
 	"github.com/pkg/errors"
 )
 
-func (w *Worker) run(ctx context.Context, rank int64, tid int64) (ok bool, err error) {
-	// Prepare the run script
-	cli, er := client.NewClient(config.GlobalConfig.DockerServer, config.GlobalConfig.DockerVersion, nil, nil)
-	if er != nil {
-		err = errors.Wrap(er, fmt.Sprintf("Run error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
-		return
-	}
-
-	insp, er := cli.ContainerInspect(ctx, w.containerID)
+// WaitHelper of the image runs the program and writes how it ended to
+// RunStatus of the work dir, see DockerImage/djudge-wait.c
+const (
+	WaitHelper = "/usr/local/bin/djudge-wait"
+	RunStatus  = "run.status"
+)
 
+// run runs the program on the testcase, ok is false when the run fails
+// already and the output needs no compare
+func (w *Worker) run(ctx context.Context, tinfo config.TestcaseInfo) (res config.RunResult, ok bool, err error) {
+	rank := tinfo.Rank
+	// Prepare the run script
 	// Prepare the execdir
 	execdir := filepath.Join(w.WorkDir, "execdir")
 	if _, err = os.Stat(execdir); os.IsNotExist(err) {
@@ -32,12 +34,36 @@ func (w *Worker) run(ctx context.Context, rank int64, tid int64) (ok bool, err e
 		err = errors.Wrap(err, fmt.Sprintf("Run error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
 		return
 	}
+	// The only dir the program can write, the sticky bit keeps it from
+	// replacing the files put there for the compare script
+	err = os.Chmod(execdir, 0777|os.ModeSticky)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("Run error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
+		return
+	}
+
+	// The checker writes its messages into the feedback dir
+	err = os.Mkdir(filepath.Join(execdir, "feedback"), DirPerm)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("Run error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
+		return
+	}
 
 	// Link the file to execdir
 	testcase_in := filepath.Join(w.WorkDir, fmt.Sprintf("testcase%03d.in", rank))
 	testcase_out := filepath.Join(w.WorkDir, fmt.Sprintf("testcase%03d.out", rank))
 	link_in := filepath.Join(execdir, "testcase.in")
 	link_out := filepath.Join(execdir, "testcase.out")
+	// Hide the expected output from the program, the link shares the mode.
+	// The input is hidden too, the same file in the cache may be the output
+	// of another testcase, and the program gets it from the run script anyway
+	for _, f := range []string{testcase_in, testcase_out} {
+		err = os.Chmod(f, TestcasePerm)
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("Run error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
+			return
+		}
+	}
 	err = os.Link(testcase_in, link_in)
 	if err != nil {
 		err = errors.Wrap(err, fmt.Sprintf("Run error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
@@ -49,57 +75,59 @@ func (w *Worker) run(ctx context.Context, rank int64, tid int64) (ok bool, err e
 		return
 	}
 
-	// Run testcase
-	pid := insp.State.Pid
-	//cmd = "/bin/bash -c run/run execdir/testcase.in execdir/program.out ./program 2> run.err; touch ./done.lck"
-	cmd := "run/run execdir/testcase.in execdir/program.out ./program 2> run.err; touch ./done.lck"
-	info, err := w.execcmd(ctx, cli, "root", cmd)
-	if err != nil {
+	// Run testcase, the output limit is enforced by the file size limit of
+	// the program, it will be killed by SIGXFSZ when exceeding it. The run
+	// is confined to the memory limit of the problem
+	err = os.Remove(filepath.Join(w.WorkDir, RunStatus))
+	if err != nil && !os.IsNotExist(err) {
 		err = errors.Wrap(err, fmt.Sprintf("Run error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
 		return
 	}
-	runinfo, er := w.runProtect(ctx, &insp, pid, uint64(w.JudgeInfo.TimeLimit), w.JudgeInfo.OutputLimit, "execdir/program.out")
+	cmd := measured(fmt.Sprintf("run/run execdir/testcase.in execdir/program.out %s 2> run.err", w.runAs("./program")))
+	outputfile := "execdir/program.out"
+	if w.JudgeInfo.CombinedRunCompare {
+		cmd, err = w.interactCmd()
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("Run error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
+			return
+		}
+		outputfile = "execdir/interaction.out"
+	}
+	cpulim, walllim := w.timeLimits()
 	log.Debugf("run protect protecting %s", cmd)
+	runinfo, info, err := w.runProtect(ctx, "root", cmd, w.JudgeInfo.MemLimit*1024, walllim, w.JudgeInfo.OutputLimit*1024, outputfile)
 	log.Infof("run protect [run] done, runinfo %+v", runinfo)
-	if er != nil {
+	if err != nil {
 		err = errors.Wrap(err, fmt.Sprintf("Run error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
 		return
 	}
 	log.Debugf("Testcase run done, info %+v", runinfo)
 
 	// Report the result if run error
-	res := config.RunResult{}
-	res.RunTime = float64(runinfo.usedtime) * 1.0 / 1000 / 1000 / 1000
-	res.TestcaseID = tid
+	res.CPUTime = float64(runinfo.usedcpu) / float64(time.Second)
+	res.WallTime = float64(runinfo.usedtime) / float64(time.Second)
+	res.RunTime = res.CPUTime
+	res.TestcaseID = tinfo.TestcaseID
+	res.JudgeTaskID = tinfo.JudgeTaskID
 	res.JudgingID = w.JudgeInfo.JudgingID
 
-	// Parse system meta and send to output system
-	// For Domjudge compability
-
-	// Make the systemMeta look like this = =
-	/*
-		Timelimit exceeded.
-		runtime: 1.860s cpu, 2.200s wall
-		memory used: 131072 bytes
-	*/
-	res.OutputSystem = fmt.Sprintf("%s.\nruntime: %fs cpu, %fs wall:\nmemory used: %dbytes\n", res.RunResult, res.RunTime, res.RunTime, runinfo.usedmem)
-	log.Debugf("system meta %s", res.OutputSystem)
-	// Save for Judge use
-	ioutil.WriteFile(filepath.Join(execdir, "program.meta"), []byte(res.OutputSystem), FilePerm)
-
-	res.RunResult = ""
-	if runinfo.timeexceed {
-		res.RunResult = config.ResTLE
-	}
-	if runinfo.memexceed {
-		res.RunResult = config.ResRE
+	exitcode, signal, err := w.waitStatus(info.ExitCode)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("Run error on Run#%d case %d", w.JudgeInfo.SubmitID, rank))
+		return
 	}
-	if runinfo.outputexceed {
-		res.RunResult = config.ResRE
+	res.ExitCode = exitcode
+	res.Signal = signal
+	res.RunResult = runVerdict(runinfo, cpulim, exitcode, signal)
+	// The program usually gets SIGPIPE when the interactor rejects and
+	// exits early, the verdict of the interactor wins then
+	if res.RunResult == config.ResRE && w.JudgeInfo.CombinedRunCompare {
+		verdict, er := w.interactorVerdict(execdir)
+		if er == nil && verdict != config.ResAC {
+			res.RunResult = ""
+		}
 	}
-	// If not these error, then it is runtime error
-	if info.ExitCode != 0 {
-		res.RunResult = config.ResRE
+	if res.RunResult == config.ResRE || res.RunResult == config.ResRF {
 		reinfo, er := ioutil.ReadFile(filepath.Join(w.WorkDir, "run.err"))
 		if er != nil {
 			err = errors.Wrap(er, "run error")
@@ -108,16 +136,143 @@ func (w *Worker) run(ctx context.Context, rank int64, tid int64) (ok bool, err e
 		res.OutputError = fmt.Sprintf("%s", reinfo)
 	}
 
-	// Run error, post to Server
-	if res.RunResult != "" {
-		err = request.PostResult(ctx, res)
-		if err != nil {
-			err = errors.Wrap(err, "run error")
-			return
-		}
-		ok = false
+	// For Domjudge compability, save for Judge use. The program may have
+	// left something there, like a link to a file of the judgehost
+	res.OutputSystem = systemMeta(res, runinfo.usedmem)
+	log.Debugf("system meta %s", res.OutputSystem)
+	os.Remove(filepath.Join(execdir, "program.meta"))
+	ioutil.WriteFile(filepath.Join(execdir, "program.meta"), []byte(res.OutputSystem), FilePerm)
+
+	// The run is judged already if it fails, no need to compare
+	ok = res.RunResult == ""
+	return
+}
+
+// runVerdict decides the verdict of a run, it is empty if the run did not
+// fail. signal is the one killing the program, if any. The program killed
+// by the OOM killer or the guard exits abnormally too, so the limits are
+// checked before the exit code
+func runVerdict(info runinfo, cpulim time.Duration, exitcode int, signal int) (verdict string) {
+	switch {
+	case info.memexceed:
+		verdict = config.ResMLE
+	case info.timeexceed || info.usedcpu > int64(cpulim):
+		// Exceeding the soft CPU limit is also time limit exceed
+		verdict = config.ResTLE
+	case info.outputexceed || signal == int(syscall.SIGXFSZ):
+		verdict = config.ResOLE
+	case signal == int(syscall.SIGSYS):
+		// Killed by the seccomp profile
+		verdict = config.ResRF
+	case exitcode != 0:
+		verdict = config.ResRE
+	}
+	return
+}
+
+// interactCmd connects the program and the interactor with two fifos, what
+// they send to each other is saved in execdir/interaction.in (to the
+// program) and execdir/interaction.out (from the program). The exit code of
+// the program is the exit code of the command, the one of the interactor is
+// saved in execdir/interactor.exit for the judge. Only the program is
+// measured, the interactor and tee do not count toward its limits
+func (w *Worker) interactCmd() (cmd string, err error) {
+	checker, err := w.checkerType()
+	if err != nil {
+		return
+	}
+	interactor := fmt.Sprintf("compare/run execdir/testcase.in execdir/testcase.out execdir/feedback %s", shellArgs(w.JudgeInfo.CompareArgs))
+	if checker == CheckerTestlib {
+		interactor = fmt.Sprintf("compare/run execdir/testcase.in execdir/feedback/interactor.out execdir/testcase.out execdir/feedback/judgemessage.txt %s", shellArgs(w.JudgeInfo.CompareArgs))
+	}
+	cmd = fmt.Sprintf("mkfifo execdir/to-program execdir/from-program; "+
+		"{ %s < execdir/from-program 2> compare.err; echo $? > execdir/interactor.exit; } | tee execdir/interaction.in > execdir/to-program & "+
+		"%s < execdir/to-program 2> run.err | tee execdir/interaction.out > execdir/from-program; "+
+		"code=${PIPESTATUS[0]}; wait; exit $code", interactor, measured(w.runAs("./program")))
+	return
+}
+
+// runAs wraps the command of the program with WaitHelper, which runs it as
+// the run user with the output limit of the problem and records how it
+// ended to RunStatus. The rest of the command (the run script, the
+// interactor) stays root and has no output limit
+func (w *Worker) runAs(cmd string) string {
+	user := w.RunUser
+	if user == "" {
+		user = "root"
+	}
+	return fmt.Sprintf("%s %s %s %d %s", WaitHelper, filepath.Join(SandboxRoot, RunStatus), shellQuote(user), w.JudgeInfo.OutputLimit, cmd)
+}
+
+// waitStatus reads how the program ended from RunStatus, the program killed
+// by a signal has exit code 128+signal. If the program was never started the
+// exit code is cmdcode, the one of the command
+func (w *Worker) waitStatus(cmdcode int) (exitcode int, signal int, err error) {
+	exitcode = cmdcode
+	data, err := ioutil.ReadFile(filepath.Join(w.WorkDir, RunStatus))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		err = errors.Wrap(err, "read wait status error")
+		return
+	}
+	var how string
+	var n int
+	_, err = fmt.Sscanf(string(data), "%s %d", &how, &n)
+	if err != nil {
+		err = errors.Wrap(err, fmt.Sprintf("read wait status error: bad status %q", data))
 		return
 	}
-	ok = true
+	switch how {
+	case "exited":
+		exitcode = n
+	case "signaled":
+		exitcode = 128 + n
+		signal = n
+	default:
+		err = errors.New(fmt.Sprintf("read wait status error: bad status %q", data))
+	}
 	return
 }
+
+// timeLimits returns the soft CPU time limit and the hard wall time limit of a testcase run
+func (w *Worker) timeLimits() (cpulim time.Duration, walllim time.Duration) {
+	cpufactor := config.GlobalConfig.CPUTimeFactor
+	if cpufactor <= 0 {
+		cpufactor = 1
+	}
+	wallfactor := config.GlobalConfig.WallTimeFactor
+	if wallfactor <= 0 {
+		wallfactor = 2
+	}
+	lim := time.Duration(w.JudgeInfo.TimeLimit * float64(time.Second))
+	cpulim = time.Duration(float64(lim) * cpufactor)
+	walllim = time.Duration(float64(lim) * wallfactor)
+	return
+}
+
+// systemMeta formats the run info like DOMjudge does, it looks like
+//
+//	Timelimit exceeded.
+//	runtime: 1.860s cpu, 2.200s wall
+//	memory used: 131072 bytes
+func systemMeta(res config.RunResult, usedmem uint64) string {
+	head := "Normal program termination"
+	switch {
+	case res.RunResult == config.ResTLE:
+		head = "Timelimit exceeded"
+	case res.RunResult == config.ResMLE:
+		head = "Memory limit exceeded"
+	case res.RunResult == config.ResOLE:
+		head = "Output limit exceeded"
+	case res.RunResult == config.ResRF:
+		head = "Restricted function, program terminated by signal 31 (bad system call)"
+	case res.Signal != 0:
+		head = fmt.Sprintf("Program terminated by signal %d (%s)", res.Signal, syscall.Signal(res.Signal))
+	case res.ExitCode != 0:
+		head = fmt.Sprintf("Non-zero exitcode %d", res.ExitCode)
+	}
+	return fmt.Sprintf("%s.\nruntime: %.3fs cpu, %.3fs wall\nmemory used: %d bytes\nexit code: %d\n", head, res.CPUTime, res.WallTime, usedmem, res.ExitCode)
+}
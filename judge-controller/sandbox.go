@@ -0,0 +1,65 @@
+package controller
+
+// Sandbox is what the judgings run in, the controller only talks to the
+// container runtime through it
+
+import (
+	"context"
+	"io"
+)
+
+// ContainerSpec describes the container to create
+type ContainerSpec struct {
+	Image  string
+	Dir    string // Host dir bound to SandboxRoot
+	CPU    int
+	Memory int64 // In bytes, swap is not allowed
+	Pids   int64
+	Labels map[string]string
+	// Syscalls killing the process with SIGSYS, and the capabilities kept
+	// (the others are dropped), see profileSpec
+	Seccomp []string
+	Caps    []string
+}
+
+// ContainerState is the state of a container
+type ContainerState struct {
+	Running bool
+	Pid     int // Pid of the init process on the host
+}
+
+// ContainerInfo is a container found by List
+type ContainerInfo struct {
+	ID     string
+	Labels map[string]string
+}
+
+// ExecInfo is the state of a command started by Exec
+type ExecInfo struct {
+	Running  bool
+	ExitCode int
+}
+
+type Sandbox interface {
+	// Create creates and starts a container, the init process keeps it
+	// running until it is stopped
+	Create(ctx context.Context, spec ContainerSpec) (id string, err error)
+	// Exec starts cmd in the container with /bin/bash -c, output is the
+	// stdout and stderr of it and ends when it exits
+	Exec(ctx context.Context, id string, user string, cmd string) (execID string, output io.ReadCloser, err error)
+	ExecInspect(ctx context.Context, execID string) (info ExecInfo, err error)
+	Inspect(ctx context.Context, id string) (state ContainerState, err error)
+	// SetMemory limits the memory of the container to lim bytes
+	SetMemory(ctx context.Context, id string, lim int64) (err error)
+	Stop(ctx context.Context, id string) (err error)
+	// Remove removes the container, a running one is killed first
+	Remove(ctx context.Context, id string) (err error)
+	// List returns all containers with the label
+	List(ctx context.Context, label string, value string) (list []ContainerInfo, err error)
+	// Changes returns the changes of the container to its image, like "1 /tmp/a"
+	Changes(ctx context.Context, id string) (changes map[string]bool, err error)
+	// Processes returns the number of processes in the container
+	Processes(ctx context.Context, id string) (n int, err error)
+	// Healthy tells whether the runtime answered the last check, err is why not
+	Healthy() (healthy bool, err error)
+}
@@ -0,0 +1,124 @@
+package controller
+
+// Partial scoring of a judging
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/VOID001/D-judge/config"
+	"github.com/pkg/errors"
+)
+
+// scorer sums up the points of a judging according to the scoring policy
+type scorer struct {
+	policy string
+	total  float64
+	groups map[string]*groupScore
+}
+
+type groupScore struct {
+	points  float64 // Points of all testcases run in the group
+	ratio   float64 // Lowest ratio scored by the testcases of the group
+	verdict string  // Verdict of the testcase first failed in the group
+	rank    int64   // Rank of the testcase first failed in the group
+}
+
+func newScorer(policy string) (sc *scorer, err error) {
+	switch policy {
+	case config.ScoringICPC, config.ScoringSum, config.ScoringGroup:
+	default:
+		err = errors.New(fmt.Sprintf("unknown scoring policy %s", policy))
+		return
+	}
+	sc = &scorer{policy: policy, groups: make(map[string]*groupScore)}
+	return
+}
+
+// points returns the points of the testcase
+func points(tinfo config.TestcaseInfo) float64 {
+	if tinfo.Points <= 0 {
+		return 1
+	}
+	return tinfo.Points
+}
+
+// add counts the run of the testcase, ratio is the part of the points scored
+func (sc *scorer) add(tinfo config.TestcaseInfo, res config.RunResult, ratio float64) {
+	if sc.policy != config.ScoringGroup {
+		sc.total += ratio * points(tinfo)
+		return
+	}
+	g, ok := sc.groups[tinfo.Group]
+	if !ok {
+		g = &groupScore{ratio: 1}
+		sc.groups[tinfo.Group] = g
+	}
+	g.points += points(tinfo)
+	if ratio < g.ratio {
+		g.ratio = ratio
+	}
+	if res.RunResult != config.ResAC && g.verdict == "" {
+		g.verdict = res.RunResult
+		g.rank = tinfo.Rank
+	}
+}
+
+// skip tells whether the testcase can be skipped, as its group scores nothing
+// already. The verdict and rank of the testcase failed the group are returned
+func (sc *scorer) skip(tinfo config.TestcaseInfo) (skip bool, verdict string, rank int64) {
+	if sc.policy != config.ScoringGroup {
+		return
+	}
+	g, ok := sc.groups[tinfo.Group]
+	if !ok || g.ratio > 0 {
+		return
+	}
+	return true, g.verdict, g.rank
+}
+
+// stop tells whether the judging stops after the run
+func (sc *scorer) stop(res config.RunResult) bool {
+	return sc.policy == config.ScoringICPC && res.RunResult != config.ResAC
+}
+
+// score returns the total points of the judging
+func (sc *scorer) score() float64 {
+	total := sc.total
+	for _, g := range sc.groups {
+		total += g.ratio * g.points
+	}
+	return total
+}
+
+// scoreRatio returns the part of the points the run scores, the checker can
+// write a number between 0 and 1 into score.txt of the feedback dir,
+// otherwise the run scores all if correct and nothing if not
+func scoreRatio(execdir string, verdict string) (ratio float64, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(execdir, "feedback", "score.txt"))
+	if os.IsNotExist(err) {
+		err = nil
+		if verdict == config.ResAC {
+			ratio = 1
+		}
+		return
+	}
+	if err != nil {
+		err = errors.Wrap(err, "read score error")
+		return
+	}
+	ratio, err = strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		err = errors.Wrap(err, "read score error")
+		return
+	}
+	if ratio < 0 || ratio > 1 {
+		err = errors.New(fmt.Sprintf("read score error: score %f not between 0 and 1", ratio))
+		return
+	}
+	return
+}
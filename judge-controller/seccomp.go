@@ -0,0 +1,237 @@
+package controller
+
+// Seccomp filter of the commands run in the namespace sandbox
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Seccomp return values, from linux/seccomp.h
+const (
+	seccompRetKill  = 0x80000000 // SECCOMP_RET_KILL_PROCESS
+	seccompRetErrno = 0x00050000 // SECCOMP_RET_ERRNO, the errno is the low 16 bits
+	seccompRetAllow = 0x7fff0000
+)
+
+// syscallNumbers are the syscalls a profile can deny in the namespace
+// sandbox, the docker one knows all of them
+var syscallNumbers = map[string]uintptr{
+	"mount":             unix.SYS_MOUNT,
+	"umount2":           unix.SYS_UMOUNT2,
+	"pivot_root":        unix.SYS_PIVOT_ROOT,
+	"chroot":            unix.SYS_CHROOT,
+	"unshare":           unix.SYS_UNSHARE,
+	"setns":             unix.SYS_SETNS,
+	"ptrace":            unix.SYS_PTRACE,
+	"process_vm_readv":  unix.SYS_PROCESS_VM_READV,
+	"process_vm_writev": unix.SYS_PROCESS_VM_WRITEV,
+	"reboot":            unix.SYS_REBOOT,
+	"kexec_load":        unix.SYS_KEXEC_LOAD,
+	"init_module":       unix.SYS_INIT_MODULE,
+	"finit_module":      unix.SYS_FINIT_MODULE,
+	"delete_module":     unix.SYS_DELETE_MODULE,
+	"swapon":            unix.SYS_SWAPON,
+	"swapoff":           unix.SYS_SWAPOFF,
+	"acct":              unix.SYS_ACCT,
+	"syslog":            unix.SYS_SYSLOG,
+	"settimeofday":      unix.SYS_SETTIMEOFDAY,
+	"clock_settime":     unix.SYS_CLOCK_SETTIME,
+	"bpf":               unix.SYS_BPF,
+	"perf_event_open":   unix.SYS_PERF_EVENT_OPEN,
+	"userfaultfd":       unix.SYS_USERFAULTFD,
+	"keyctl":            unix.SYS_KEYCTL,
+	"add_key":           unix.SYS_ADD_KEY,
+	"request_key":       unix.SYS_REQUEST_KEY,
+	"name_to_handle_at": unix.SYS_NAME_TO_HANDLE_AT,
+	"open_by_handle_at": unix.SYS_OPEN_BY_HANDLE_AT,
+	"socket":            unix.SYS_SOCKET,
+	"socketpair":        unix.SYS_SOCKETPAIR,
+	"connect":           unix.SYS_CONNECT,
+	"bind":              unix.SYS_BIND,
+	"listen":            unix.SYS_LISTEN,
+	"accept4":           unix.SYS_ACCEPT4,
+	"clone3":            unix.SYS_CLONE3,
+	"execveat":          unix.SYS_EXECVEAT,
+	"fsopen":            unix.SYS_FSOPEN,
+	"fsconfig":          unix.SYS_FSCONFIG,
+	"fsmount":           unix.SYS_FSMOUNT,
+	"fspick":            unix.SYS_FSPICK,
+	"move_mount":        unix.SYS_MOVE_MOUNT,
+	"open_tree":         unix.SYS_OPEN_TREE,
+	"mount_setattr":     unix.SYS_MOUNT_SETATTR,
+	"kcmp":              unix.SYS_KCMP,
+	"io_uring_setup":    unix.SYS_IO_URING_SETUP,
+	"io_uring_enter":    unix.SYS_IO_URING_ENTER,
+	"io_uring_register": unix.SYS_IO_URING_REGISTER,
+	"personality":       unix.SYS_PERSONALITY,
+	"quotactl":          unix.SYS_QUOTACTL,
+	"quotactl_fd":       unix.SYS_QUOTACTL_FD,
+	"kexec_file_load":   unix.SYS_KEXEC_FILE_LOAD,
+	"lookup_dcookie":    unix.SYS_LOOKUP_DCOOKIE,
+	"sethostname":       unix.SYS_SETHOSTNAME,
+	"setdomainname":     unix.SYS_SETDOMAINNAME,
+	"clock_adjtime":     unix.SYS_CLOCK_ADJTIME,
+}
+
+// capNumbers are the capabilities a profile can keep
+var capNumbers = map[string]uintptr{
+	"CHOWN":            unix.CAP_CHOWN,
+	"DAC_OVERRIDE":     unix.CAP_DAC_OVERRIDE,
+	"DAC_READ_SEARCH":  unix.CAP_DAC_READ_SEARCH,
+	"FOWNER":           unix.CAP_FOWNER,
+	"FSETID":           unix.CAP_FSETID,
+	"KILL":             unix.CAP_KILL,
+	"SETGID":           unix.CAP_SETGID,
+	"SETUID":           unix.CAP_SETUID,
+	"SETPCAP":          unix.CAP_SETPCAP,
+	"NET_BIND_SERVICE": unix.CAP_NET_BIND_SERVICE,
+	"NET_RAW":          unix.CAP_NET_RAW,
+	"IPC_LOCK":         unix.CAP_IPC_LOCK,
+	"SYS_CHROOT":       unix.CAP_SYS_CHROOT,
+	"SYS_PTRACE":       unix.CAP_SYS_PTRACE,
+	"SYS_NICE":         unix.CAP_SYS_NICE,
+	"SYS_RESOURCE":     unix.CAP_SYS_RESOURCE,
+	"MKNOD":            unix.CAP_MKNOD,
+	"AUDIT_WRITE":      unix.CAP_AUDIT_WRITE,
+	"SETFCAP":          unix.CAP_SETFCAP,
+}
+
+// lookupSyscalls returns the numbers of the syscalls
+func lookupSyscalls(names []string) (nrs []uintptr, err error) {
+	for _, name := range names {
+		nr, ok := syscallNumbers[name]
+		if !ok {
+			err = errors.New(fmt.Sprintf("syscall %s is not supported by the namespace sandbox", name))
+			return
+		}
+		nrs = append(nrs, nr)
+	}
+	return
+}
+
+// lookupCaps returns the numbers of the capabilities, CAP_ is optional
+func lookupCaps(names []string) (caps []uintptr, err error) {
+	for _, name := range names {
+		c, ok := capNumbers[strings.TrimPrefix(strings.ToUpper(name), "CAP_")]
+		if !ok {
+			err = errors.New(fmt.Sprintf("capability %s is not supported by the namespace sandbox", name))
+			return
+		}
+		caps = append(caps, c)
+	}
+	return
+}
+
+// dropCaps drops the capabilities but caps from the bounding set and the
+// calling thread, it needs SETPCAP so do it as root
+func dropCaps(caps []uintptr) (err error) {
+	kept := uint64(0)
+	for _, c := range caps {
+		kept |= 1 << c
+	}
+	for c := uintptr(0); c <= unix.CAP_LAST_CAP; c++ {
+		if kept&(1<<c) != 0 {
+			continue
+		}
+		err = unix.Prctl(unix.PR_CAPBSET_DROP, c, 0, 0, 0)
+		// Capabilities newer than the kernel are not there at all
+		if err != nil && err != unix.EINVAL {
+			err = errors.Wrap(err, "drop capabilities error")
+			return
+		}
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{}
+	for i := range data {
+		data[i].Effective = uint32(kept >> (32 * uint(i)))
+		data[i].Permitted = data[i].Effective
+	}
+	err = unix.Capset(&hdr, &data[0])
+	if err != nil {
+		err = errors.Wrap(err, "drop capabilities error")
+		return
+	}
+	return
+}
+
+// auditArch returns the AUDIT_ARCH of the judgehost, syscalls of other
+// architectures (like 32 bit ones on amd64) are not allowed at all
+func auditArch() (arch uint32, err error) {
+	switch runtime.GOARCH {
+	case "amd64":
+		arch = unix.AUDIT_ARCH_X86_64
+	case "arm64":
+		arch = unix.AUDIT_ARCH_AARCH64
+	default:
+		err = errors.New(fmt.Sprintf("seccomp is not supported on %s", runtime.GOARCH))
+	}
+	return
+}
+
+// seccompFilter builds the BPF program killing the process on the denied
+// syscalls and clone with NamespaceCloneFlags, it dies of SIGSYS. clone3
+// fails with ENOSYS
+func seccompFilter(denied []uintptr) (prog []unix.SockFilter, err error) {
+	arch, err := auditArch()
+	if err != nil {
+		return
+	}
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt uint8, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	// struct seccomp_data { int nr; __u32 arch; ... }
+	prog = append(prog,
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 4),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetKill),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 0),
+		// The x32 ABI of amd64
+		jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, 0x40000000, 0, 1),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetKill),
+	)
+	for _, nr := range denied {
+		prog = append(prog,
+			jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), 0, 1),
+			stmt(unix.BPF_RET|unix.BPF_K, seccompRetKill),
+		)
+	}
+	// The flags are the low half of the first argument,
+	// struct seccomp_data { ...; __u64 instruction_pointer; __u64 args[6]; }
+	prog = append(prog,
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_CLONE, 0, 4),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 16),
+		jump(unix.BPF_JMP|unix.BPF_JSET|unix.BPF_K, NamespaceCloneFlags, 0, 1),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetKill),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_CLONE3, 0, 1),
+		stmt(unix.BPF_RET|unix.BPF_K, seccompRetErrno|uint32(unix.ENOSYS)),
+	)
+	prog = append(prog, stmt(unix.BPF_RET|unix.BPF_K, seccompRetAllow))
+	return
+}
+
+// installSeccomp applies the filter to the calling thread, the OS thread
+// should be locked and exec right after. no_new_privs is set as well
+func installSeccomp(prog []unix.SockFilter) (err error) {
+	err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		err = errors.Wrap(err, "install seccomp error")
+		return
+	}
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	err = unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0)
+	if err != nil {
+		err = errors.Wrap(err, "install seccomp error")
+		return
+	}
+	return
+}
@@ -0,0 +1,61 @@
+package controller
+
+// Security profiles of the containers, the syscalls killing the program
+// and the capabilities kept in the container
+
+import (
+	"github.com/VOID001/D-judge/config"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultDeniedSyscalls kill the program with SIGSYS, they would let it
+// escape from or reconfigure the sandbox, or mess with the judgehost
+var DefaultDeniedSyscalls = []string{
+	"mount", "umount2", "pivot_root", "chroot", "unshare", "setns",
+	"ptrace", "process_vm_readv", "process_vm_writev",
+	"reboot", "kexec_load", "init_module", "finit_module", "delete_module",
+	"swapon", "swapoff", "acct", "syslog", "settimeofday", "clock_settime",
+	"bpf", "perf_event_open", "userfaultfd", "keyctl", "add_key", "request_key",
+	"name_to_handle_at", "open_by_handle_at",
+	"fsopen", "fsconfig", "fsmount", "fspick", "move_mount", "open_tree", "mount_setattr",
+	"kcmp", "io_uring_setup", "io_uring_enter", "io_uring_register", "personality",
+	"quotactl", "quotactl_fd", "kexec_file_load", "lookup_dcookie",
+	"sethostname", "setdomainname", "clock_adjtime",
+}
+
+// NamespaceCloneFlags kill the program calling clone with any of them, as
+// unshare does. clone3 hides its flags from seccomp in a struct, so it
+// always fails with ENOSYS and the libc falls back to clone
+const NamespaceCloneFlags = unix.CLONE_NEWNS | unix.CLONE_NEWCGROUP | unix.CLONE_NEWUTS |
+	unix.CLONE_NEWIPC | unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET
+
+// DefaultCaps are kept in the container, enough for the build scripts
+// running as root and djudge-wait, all others (like NET_RAW and SYS_ADMIN) are dropped
+var DefaultCaps = []string{
+	"CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "SETGID", "SETUID", "AUDIT_WRITE",
+}
+
+// securityProfile returns the name of the profile of the language, the
+// default profile is ""
+func securityProfile(lang string) string {
+	if _, ok := config.GlobalConfig.Security[lang]; ok {
+		return lang
+	}
+	return ""
+}
+
+// profileSpec returns the denied syscalls and kept capabilities of the profile
+func profileSpec(name string) (denied []string, caps []string) {
+	p := config.GlobalConfig.Security[name]
+	allowed := make(map[string]bool)
+	for _, s := range p.Allow {
+		allowed[s] = true
+	}
+	for _, s := range append(append([]string{}, DefaultDeniedSyscalls...), p.Deny...) {
+		if !allowed[s] {
+			denied = append(denied, s)
+		}
+	}
+	caps = append(append(caps, DefaultCaps...), p.CapAdd...)
+	return
+}
@@ -0,0 +1,425 @@
+package controller
+
+// Pre-warmed containers, a judging checks out a started container of its
+// image and core instead of creating one, and gives it back when done. A
+// container is only given back when nothing is left by the judging in it
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/VOID001/D-judge/config"
+	"github.com/pkg/errors"
+)
+
+// DefaultContainerMaxUses is used when container_max_uses is not set
+const DefaultContainerMaxUses = 100
+
+// The tmpfs of a container (/tmp, and /dev/shm and /dev/mqueue where they
+// are) are not seen by Sandbox.Changes, they are wiped when the container
+// is given back and checked to be empty. So are the SysV IPC objects, they
+// live as long as the IPC namespace of the container
+const (
+	wipeTmpCmd  = "for d in /tmp /dev/shm /dev/mqueue; do test ! -d $d || find $d -mindepth 1 -delete || exit 1; done"
+	checkTmpCmd = `test -z "$(find /tmp /dev/shm /dev/mqueue -mindepth 1 2>/dev/null)"`
+	wipeIPCCmd  = "ipcrm -a"
+	checkIPCCmd = `ipcs=$(ipcs -m -q -s) && ! echo "$ipcs" | grep -q "^0x"`
+)
+
+// runID tells the containers created by this run of the judgehost from the
+// ones left by an earlier run
+var runID = fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+
+// warmKey is what a container is created for, only a judging of the same
+// key can check it out
+type warmKey struct {
+	image   string
+	cpu     int
+	memory  int64
+	pids    int64
+	profile string // Security profile
+}
+
+type warmContainer struct {
+	id       string
+	dir      string // Sandbox dir of the container, bound to SandboxRoot
+	key      warmKey
+	uses     int
+	baseline map[string]bool // Changes to the image found in the fresh container
+}
+
+type containerPool struct {
+	mu      sync.Mutex
+	sandbox Sandbox
+	root    string // Where the sandbox dirs are made
+	size    int    // Idle containers kept for each key
+	maxUses int
+	idle    map[warmKey][]*warmContainer
+	seq     int
+	closed  bool
+}
+
+// newContainerPool creates the pool, the sandbox dirs left in root by an
+// earlier run are removed
+func newContainerPool(sandbox Sandbox, root string, size int, maxUses int) (cp *containerPool, err error) {
+	if maxUses <= 0 {
+		maxUses = DefaultContainerMaxUses
+	}
+	err = os.RemoveAll(root)
+	if err != nil {
+		err = errors.Wrap(err, "create container pool error")
+		return
+	}
+	err = os.Mkdir(root, DirPerm)
+	if err != nil {
+		err = errors.Wrap(err, "create container pool error")
+		return
+	}
+	cp = &containerPool{sandbox: sandbox, root: root, size: size, maxUses: maxUses, idle: make(map[warmKey][]*warmContainer)}
+	return
+}
+
+// warm creates containers of key until size of them are idle
+func (cp *containerPool) warm(ctx context.Context, key warmKey) {
+	for {
+		cp.mu.Lock()
+		n, closed := len(cp.idle[key]), cp.closed
+		cp.mu.Unlock()
+		if n >= cp.size || closed {
+			return
+		}
+		c, err := cp.create(ctx, key)
+		if err != nil {
+			log.Error(errors.Wrap(err, "warm container error"))
+			return
+		}
+		cp.mu.Lock()
+		if cp.closed {
+			cp.mu.Unlock()
+			cp.destroy(ctx, c)
+			return
+		}
+		cp.idle[key] = append(cp.idle[key], c)
+		cp.mu.Unlock()
+		log.Debugf("warmed container %s on cpu %d", c.id, key.cpu)
+	}
+}
+
+// create creates and starts a container of key with an empty sandbox dir
+func (cp *containerPool) create(ctx context.Context, key warmKey) (c *warmContainer, err error) {
+	cp.mu.Lock()
+	cp.seq++
+	dir := filepath.Join(cp.root, fmt.Sprintf("w%d", cp.seq))
+	cp.mu.Unlock()
+	err = os.Mkdir(dir, DirPerm)
+	if err != nil {
+		err = errors.Wrap(err, "create container error")
+		return
+	}
+	id, err := cp.sandbox.Create(ctx, key.spec(dir, nil))
+	if err != nil {
+		os.RemoveAll(dir)
+		err = errors.Wrap(err, "create container error")
+		return
+	}
+	c = &warmContainer{id: id, dir: dir, key: key}
+	c.baseline, err = cp.sandbox.Changes(ctx, id)
+	if err != nil {
+		cp.destroy(ctx, c)
+		err = errors.Wrap(err, "create container error")
+		return
+	}
+	return
+}
+
+// get checks out a clean container of key, a new one is created if none is idle
+func (cp *containerPool) get(ctx context.Context, key warmKey) (c *warmContainer, err error) {
+	for {
+		cp.mu.Lock()
+		idle := cp.idle[key]
+		if len(idle) == 0 {
+			cp.mu.Unlock()
+			break
+		}
+		c = idle[len(idle)-1]
+		cp.idle[key] = idle[:len(idle)-1]
+		cp.mu.Unlock()
+		// It may be gone with a restart of docker
+		er := cp.verify(ctx, c)
+		if er == nil {
+			c.uses++
+			return
+		}
+		log.Warnf("discard warm container %s: %s", c.id, er)
+		cp.destroy(ctx, c)
+	}
+	c, err = cp.create(ctx, key)
+	if err != nil {
+		err = errors.Wrap(err, "check out container error")
+		return
+	}
+	c.uses++
+	return
+}
+
+// put gives the container back, it is recycled when it is used up or the
+// judging leaves anything in it
+func (cp *containerPool) put(ctx context.Context, c *warmContainer) {
+	err := cp.reset(ctx, c)
+	if err == nil {
+		err = cp.verify(ctx, c)
+	}
+	if err == nil && c.uses >= cp.maxUses {
+		err = errors.New(fmt.Sprintf("used %d times", c.uses))
+	}
+	if err == nil {
+		cp.mu.Lock()
+		if !cp.closed && len(cp.idle[c.key]) < cp.size {
+			cp.idle[c.key] = append(cp.idle[c.key], c)
+			cp.mu.Unlock()
+			return
+		}
+		cp.mu.Unlock()
+		cp.destroy(ctx, c)
+		return
+	}
+	log.Infof("recycle container %s: %s", c.id, err)
+	cp.destroy(ctx, c)
+	go cp.warm(context.Background(), c.key)
+}
+
+// reset restores the resource limits the judging may have changed and
+// wipes what it left in the tmpfs and the IPC namespace
+func (cp *containerPool) reset(ctx context.Context, c *warmContainer) (err error) {
+	err = cp.sandbox.SetMemory(ctx, c.id, c.key.memory)
+	if err != nil {
+		err = errors.Wrap(err, "reset container error")
+		return
+	}
+	code, err := cp.exec(ctx, c, wipeTmpCmd)
+	if err != nil {
+		err = errors.Wrap(err, "reset container error")
+		return
+	}
+	if code != 0 {
+		err = errors.New(fmt.Sprintf("reset container error: wipe /tmp exit code %d", code))
+		return
+	}
+	code, err = cp.exec(ctx, c, wipeIPCCmd)
+	if err != nil {
+		err = errors.Wrap(err, "reset container error")
+		return
+	}
+	if code != 0 {
+		err = errors.New(fmt.Sprintf("reset container error: remove ipc objects exit code %d", code))
+		return
+	}
+	return
+}
+
+// exec runs cmd as root in the container and returns its exit code
+func (cp *containerPool) exec(ctx context.Context, c *warmContainer, cmd string) (code int, err error) {
+	execID, output, err := cp.sandbox.Exec(ctx, c.id, "root", cmd)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(ioutil.Discard, output)
+	output.Close()
+	if err != nil {
+		err = errors.Wrap(err, "exec command in container error")
+		return
+	}
+	info, err := cp.sandbox.ExecInspect(ctx, execID)
+	if err != nil {
+		return
+	}
+	code = info.ExitCode
+	return
+}
+
+// verify checks the container is as clean as a fresh one: running, nothing
+// but the init process in it, no change to the image other than the
+// baseline, empty tmpfs, no IPC object and an empty sandbox dir
+func (cp *containerPool) verify(ctx context.Context, c *warmContainer) (err error) {
+	state, err := cp.sandbox.Inspect(ctx, c.id)
+	if err != nil {
+		err = errors.Wrap(err, "verify container error")
+		return
+	}
+	if !state.Running {
+		err = errors.New("verify container error: not running")
+		return
+	}
+	n, err := cp.sandbox.Processes(ctx, c.id)
+	if err != nil {
+		err = errors.Wrap(err, "verify container error")
+		return
+	}
+	if n > 1 {
+		err = errors.New(fmt.Sprintf("verify container error: %d processes left", n-1))
+		return
+	}
+	changes, err := cp.sandbox.Changes(ctx, c.id)
+	if err != nil {
+		err = errors.Wrap(err, "verify container error")
+		return
+	}
+	for ch := range changes {
+		if !c.baseline[ch] {
+			err = errors.New(fmt.Sprintf("verify container error: %s changed", ch))
+			return
+		}
+	}
+	code, err := cp.exec(ctx, c, checkTmpCmd)
+	if err != nil {
+		err = errors.Wrap(err, "verify container error")
+		return
+	}
+	if code != 0 {
+		err = errors.New("verify container error: /tmp is not empty")
+		return
+	}
+	code, err = cp.exec(ctx, c, checkIPCCmd)
+	if err != nil {
+		err = errors.Wrap(err, "verify container error")
+		return
+	}
+	if code != 0 {
+		err = errors.New("verify container error: ipc objects left")
+		return
+	}
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		err = errors.Wrap(err, "verify container error")
+		return
+	}
+	if len(files) > 0 {
+		err = errors.New(fmt.Sprintf("verify container error: %s left in sandbox", files[0].Name()))
+		return
+	}
+	return
+}
+
+// destroy removes the container and its sandbox dir
+func (cp *containerPool) destroy(ctx context.Context, c *warmContainer) {
+	err := cp.sandbox.Remove(ctx, c.id)
+	if err != nil {
+		log.Warn(errors.Wrap(err, "destroy container error"))
+	}
+	err = os.RemoveAll(c.dir)
+	if err != nil {
+		log.Warn(errors.Wrap(err, "destroy container error"))
+	}
+}
+
+// close removes all idle containers, containers given back later are removed too
+func (cp *containerPool) close(ctx context.Context) {
+	cp.mu.Lock()
+	cp.closed = true
+	idle := cp.idle
+	cp.idle = make(map[warmKey][]*warmContainer)
+	cp.mu.Unlock()
+	for _, cs := range idle {
+		for _, c := range cs {
+			cp.destroy(ctx, c)
+		}
+	}
+}
+
+// spec returns the spec of the container of key with dir bound to SandboxRoot
+func (key warmKey) spec(dir string, labels map[string]string) ContainerSpec {
+	spec := ContainerSpec{
+		Image:  key.image,
+		Dir:    dir,
+		CPU:    key.cpu,
+		Memory: key.memory,
+		Pids:   key.pids,
+		Labels: map[string]string{
+			LabelHost: config.GlobalConfig.HostName,
+			LabelRun:  runID,
+		},
+	}
+	spec.Seccomp, spec.Caps = profileSpec(key.profile)
+	for k, v := range labels {
+		spec.Labels[k] = v
+	}
+	return spec
+}
+
+// key returns the key of the container the worker needs
+func (w *Worker) key() warmKey {
+	return warmKey{image: w.DockerImage, cpu: w.CPUID, memory: w.rootMemory, pids: w.pidsLimit, profile: securityProfile(w.JudgeInfo.Language)}
+}
+
+// startContainer starts the container of the judging, a warm one is checked
+// out when the container pool is enabled. Then the files prepared in the
+// work dir are moved into the sandbox dir of the container, which is the
+// work dir until cleanup
+func (w *Worker) startContainer(ctx context.Context) (err error) {
+	if w.containers == nil {
+		labels := map[string]string{LabelJudging: fmt.Sprintf("%d", w.JudgeInfo.JudgingID)}
+		log.Infof("Binds %s", fmt.Sprintf("%s:%s", w.WorkDir, SandboxRoot))
+		w.containerID, err = w.sandbox.Create(ctx, w.key().spec(w.WorkDir, labels))
+		if err != nil {
+			err = errors.Wrap(err, "start container error")
+			return
+		}
+		return
+	}
+	c, err := w.containers.get(ctx, w.key())
+	if err != nil {
+		err = errors.Wrap(err, "start container error")
+		return
+	}
+	err = moveEntries(w.WorkDir, c.dir)
+	if err != nil {
+		// Whatever moved is left there, so the container is recycled
+		w.containers.put(ctx, c)
+		err = errors.Wrap(err, "start container error")
+		return
+	}
+	w.warm = c
+	w.containerID = c.id
+	w.judgingDir = w.WorkDir
+	w.WorkDir = c.dir
+	return
+}
+
+// returnContainer moves the files of the judging back to its work dir and
+// gives the container back to the pool
+func (w *Worker) returnContainer(ctx context.Context) (err error) {
+	c := w.warm
+	w.warm = nil
+	w.WorkDir = w.judgingDir
+	w.judgingDir = ""
+	err = moveEntries(c.dir, w.WorkDir)
+	if err != nil {
+		err = errors.Wrap(err, "return container error")
+	}
+	w.containers.put(ctx, c)
+	return
+}
+
+// moveEntries moves everything in dir from into dir to
+func moveEntries(from string, to string) (err error) {
+	files, err := ioutil.ReadDir(from)
+	if err != nil {
+		err = errors.Wrap(err, "move entries error")
+		return
+	}
+	for _, f := range files {
+		err = os.Rename(filepath.Join(from, f.Name()), filepath.Join(to, f.Name()))
+		if err != nil {
+			err = errors.Wrap(err, "move entries error")
+			return
+		}
+	}
+	return
+}
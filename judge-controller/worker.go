@@ -2,23 +2,18 @@ package controller
 
 import (
 	"context"
-	"fmt"
-	"io/ioutil"
-	"path/filepath"
-	"strconv"
-	"strings"
 
 	"github.com/pkg/errors"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/VOID001/D-judge/config"
-	"github.com/docker/engine-api/client"
-	"github.com/docker/engine-api/types"
+	"github.com/VOID001/D-judge/judge-server"
 )
 
 type runinfo struct {
 	usedmem      uint64
-	usedtime     int64
+	usedtime     int64 // Wall time in nanoseconds
+	usedcpu      int64 // CPU time in nanoseconds
 	outputexceed bool
 	timeexceed   bool
 	memexceed    bool
@@ -31,52 +26,63 @@ type Worker struct {
 	RunUser      string
 	CPUID        int
 	MaxRetryTime int
+	judgeServer  server.JudgeServer
 	containerID  string
 	codeFileName string
+	cg           *cgroup
+	journalDir   string // Where the journal is saved, empty if not journaled
+	state        string // State of the judging in the journal
+	rank         int64  // Rank of the last reported testcase
+	rootMemory   int64  // Memory limit of the container when not running the program
+	pidsLimit    int64
+	sandbox      Sandbox        // Where the containers are created, shared by the workers of the daemon
+	containers   *containerPool // Warm containers, nil to create a container for each judging
+	warm         *warmContainer // Container checked out of containers
+	judgingDir   string         // Work dir of the judging while WorkDir is the sandbox dir of warm
+	prefetch     *prefetcher    // Testcases downloading while building, nil if not prefetched
 }
 
 const (
-	FilePerm    = 0644
-	DirPerm     = 0755
-	SandboxRoot = "/sandbox"
+	FilePerm     = 0644
+	DirPerm      = 0755
+	TestcasePerm = 0600 // The run user cannot read the testcases
+	SandboxRoot  = "/sandbox"
 )
 
+// DefaultRunUser runs the program when run_user is not set, the image
+// needs the user
+const DefaultRunUser = "judge"
+
 func (w *Worker) cleanup(ctx context.Context) (err error) {
 	log.Debugf("doing cleanup for containerID %s", w.containerID)
-	cli, er := client.NewClient(config.GlobalConfig.DockerServer, config.GlobalConfig.DockerVersion, nil, nil)
-	if er != nil {
-		err = errors.Wrap(er, "worker cleanup error")
-		return err
+	// Clean up the canceled judging too
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+	w.cg = nil
+	// Cleaned up already, or no container created
+	if w.containerID == "" {
+		return
 	}
-	err = cli.ContainerStop(ctx, w.containerID, nil)
+	if w.warm != nil {
+		w.containerID = ""
+		err = w.returnContainer(ctx)
+		if err != nil {
+			err = errors.Wrap(err, "worker cleanup error")
+			return err
+		}
+		return
+	}
+	err = w.sandbox.Stop(ctx, w.containerID)
 	if err != nil {
 		err = errors.Wrap(err, "worker cleanup error")
 		return err
 	}
-	err = cli.ContainerRemove(ctx, w.containerID, types.ContainerRemoveOptions{})
+	err = w.sandbox.Remove(ctx, w.containerID)
 	if err != nil {
 		err = errors.Wrap(err, "worker cleanup error")
 		return err
 	}
-	return
-}
-
-func (w *Worker) readExitCode(ctx context.Context) (code int, err error) {
-	// Read the file exitcode and return
-
-	path := filepath.Join(w.WorkDir, "exitcode")
-	data, er := ioutil.ReadFile(path)
-	if er != nil {
-		err = errors.Wrap(er, "read exit code from file error")
-		return
-	}
-	str := fmt.Sprintf("%s", data)
-	str = strings.TrimSuffix(str, "\n")
-	str = strings.TrimPrefix(str, "\n")
-	code, err = strconv.Atoi(str)
-	if err != nil {
-		err = errors.Wrap(err, "read exit code from file error")
-		return
-	}
+	w.containerID = ""
 	return
 }
@@ -1,15 +1,28 @@
 package controller
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/VOID001/D-judge/config"
-	"github.com/docker/engine-api/client"
-	"github.com/docker/engine-api/types"
-	"github.com/docker/engine-api/types/container"
+	"github.com/VOID001/D-judge/judge-server"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
 )
 
 var GlobalConfig = config.SystemConfig{
@@ -50,6 +63,7 @@ func TestWorkerPrepare(t *testing.T) {
 		CompareZipMD5: "71306aae6e243f8a030ab1bd7d6b354b",
 		CompareArgs:   "",
 	}
+	w.judgeServer = &server.NEUOJ{}
 	w.WorkDir = filepath.Join(config.GlobalConfig.JudgeRoot, "judge-test-1")
 	err := w.prepare(context.Background())
 	if err != nil {
@@ -63,50 +77,1209 @@ func TestWorkerExecCMD(t *testing.T) {
 	w := Worker{}
 	//cmd := fmt.Sprintf("compare/run execdir/testcase.in execdir/testcase.out testcase001 < execdir/program.out 2> compare.err >compare.out")
 	cmd := "sleep 5; exit 233"
-	cli, err := client.NewClient(config.GlobalConfig.DockerServer, config.GlobalConfig.DockerVersion, nil, nil)
+	docker, err := NewDockerClient(context.TODO())
 	if err != nil {
 		t.Logf("Failed error: %+v", err)
 		t.Fail()
 		return
 	}
+	w.sandbox = docker
 
-	cfg := container.Config{}
-	cfg.Image = config.GlobalConfig.DockerImage
-	cfg.User = "root" // Future will change to judge, a low-privileged user
-	cfg.Tty = true
-	cfg.WorkingDir = "/sandbox"
-	cfg.AttachStdin = false
-	cfg.AttachStderr = false
-	cfg.AttachStdout = true
-	cfg.Cmd = []string{"/bin/bash"}
-	hcfg := container.HostConfig{}
-	hcfg.Binds = []string{"/tmp/testdir:/sandbox"}
-	hcfg.Memory = config.GlobalConfig.RootMemory
-	hcfg.PidsLimit = 64 // This is enough for almost all case
-
-	resp, err := cli.ContainerCreate(context.TODO(), &cfg, &hcfg, nil, "")
+	spec := ContainerSpec{}
+	spec.Image = config.GlobalConfig.DockerImage
+	spec.Dir = "/tmp/testdir"
+	spec.Memory = config.GlobalConfig.RootMemory
+	spec.Pids = 64 // This is enough for almost all case
+	id, err := docker.Create(context.TODO(), spec)
 	if err != nil {
 		t.Logf("Failed error: %+v", err)
 		t.Fail()
 		return
 	}
-	err = cli.ContainerStart(context.TODO(), resp.ID, types.ContainerStartOptions{})
+	defer docker.Remove(context.TODO(), id)
+	w.containerID = id
+	info, err := w.execcmd(context.TODO(), "root", cmd)
 	if err != nil {
 		t.Logf("Failed error: %+v", err)
 		t.Fail()
 		return
 	}
-	w.containerID = resp.ID
-	info, err := w.execcmd(context.TODO(), cli, "root", cmd)
+	if info.ExitCode != 233 {
+		t.Logf("Expected exit code 233, got %d", info.ExitCode)
+		t.Fail()
+		return
+	}
+
+}
+
+func TestCheckerVerdict(t *testing.T) {
+	cases := []struct {
+		checker string
+		code    int
+		verdict string
+	}{
+		{CheckerDOMjudge, ExitAC, config.ResAC},
+		{CheckerDOMjudge, ExitWA, config.ResWA},
+		{CheckerTestlib, TestlibAC, config.ResAC},
+		{CheckerTestlib, TestlibWA, config.ResWA},
+		{CheckerTestlib, TestlibPE, config.ResPE},
+	}
+	for _, c := range cases {
+		verdict, err := checkerVerdict(c.checker, c.code)
+		if err != nil || verdict != c.verdict {
+			t.Logf("%s checker exit %d: expected %s, got %s err = %+v", c.checker, c.code, c.verdict, verdict, err)
+			t.Fail()
+		}
+	}
+	// testlib reports checker failure with 3
+	_, err := checkerVerdict(CheckerTestlib, 3)
+	if err == nil {
+		t.Logf("expected error on testlib checker failure")
+		t.Fail()
+	}
+}
+
+func TestSameTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "djudge-tokens")
 	if err != nil {
-		t.Logf("Failed error: %+v", err)
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	long := strings.Repeat("9", 1<<20)
+	cases := []struct {
+		a    string
+		b    string
+		same bool
+	}{
+		{"1 2\n3\n", "1 2 3", true},
+		{"  1\t2 \r\n", "1 2\n\n", true},
+		{"1 2", "12", false},
+		{"1 2", "1 2 3", false},
+		{"", " \n", true},
+		{long + "\n", long, true},
+		{long + "8", long + "9", false},
+	}
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	for i, c := range cases {
+		ioutil.WriteFile(a, []byte(c.a), FilePerm)
+		ioutil.WriteFile(b, []byte(c.b), FilePerm)
+		same, err := sameTokens(a, b)
+		if err != nil || same != c.same {
+			t.Logf("case %d expected same %v, got %v err = %+v", i, c.same, same, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestReadFeedback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "djudge-feedback")
+	if err != nil {
+		t.Logf("create temp dir error: %+v", err)
 		t.Fail()
 		return
 	}
-	if info.ExitCode != 233 {
-		t.Logf("Expected exit code 233, got %d", info.ExitCode)
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "feedback"), DirPerm)
+	stdout := filepath.Join(dir, "compare.out")
+	ioutil.WriteFile(stdout, []byte("old diff"), FilePerm)
+
+	msg, err := readFeedback(dir, stdout)
+	if err != nil || msg != "old diff" {
+		t.Logf("expected the compare stdout, got %s err = %+v", msg, err)
+		t.Fail()
+		return
+	}
+	ioutil.WriteFile(filepath.Join(dir, "feedback", "judgemessage.txt"), []byte("wrong answer on line 2\n"), FilePerm)
+	msg, err = readFeedback(dir, stdout)
+	if err != nil || msg != "wrong answer on line 2\n" {
+		t.Logf("expected the judge message, got %s err = %+v", msg, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestReadInteractorExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "djudge-interactor")
+	if err != nil {
+		t.Logf("create temp dir error: %+v", err)
+		t.Fail()
+		return
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "interactor.exit"), []byte("42\n"), FilePerm)
+	code, err := readInteractorExit(CheckerDOMjudge, dir)
+	if err != nil || code != ExitAC {
+		t.Logf("expected exit code %d, got %d err = %+v", ExitAC, code, err)
+		t.Fail()
+		return
+	}
+	// Killed by SIGPIPE as the program exits early
+	ioutil.WriteFile(filepath.Join(dir, "interactor.exit"), []byte("141\n"), FilePerm)
+	code, err = readInteractorExit(CheckerTestlib, dir)
+	if err != nil || code != TestlibWA {
+		t.Logf("expected exit code %d, got %d err = %+v", TestlibWA, code, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestScorerGroup(t *testing.T) {
+	sc, err := newScorer(config.ScoringGroup)
+	if err != nil {
+		t.Logf("create scorer error: %+v", err)
+		t.Fail()
+		return
+	}
+	ac := config.RunResult{RunResult: config.ResAC}
+	wa := config.RunResult{RunResult: config.ResWA}
+	sc.add(config.TestcaseInfo{Rank: 1, Group: "1", Points: 10}, ac, 1)
+	sc.add(config.TestcaseInfo{Rank: 2, Group: "1", Points: 10}, ac, 1)
+	sc.add(config.TestcaseInfo{Rank: 3, Group: "2", Points: 10}, wa, 0.5)
+	sc.add(config.TestcaseInfo{Rank: 4, Group: "3", Points: 10}, wa, 0)
+	if skip, _, _ := sc.skip(config.TestcaseInfo{Group: "2"}); skip {
+		t.Logf("group 2 still scores, should not skip")
+		t.Fail()
+	}
+	skip, verdict, rank := sc.skip(config.TestcaseInfo{Group: "3"})
+	if !skip || verdict != config.ResWA || rank != 4 {
+		t.Logf("expected skip group 3 failed by testcase 4, got %v %s %d", skip, verdict, rank)
+		t.Fail()
+	}
+	if sc.score() != 25 {
+		t.Logf("expected score 25, got %f", sc.score())
+		t.Fail()
+	}
+	if sc.stop(wa) {
+		t.Logf("group scoring should not stop at failed testcase")
+		t.Fail()
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "djudge-journal")
+	if err != nil {
+		t.Logf("create temp dir error: %+v", err)
+		t.Fail()
+		return
+	}
+	defer os.RemoveAll(dir)
+	w := Worker{}
+	w.JudgeInfo = config.JudgeInfo{SubmitID: 3, JudgingID: 5}
+	w.WorkDir = "/tmp/judge_root/c0-s3-j5"
+	w.journalDir = dir
+	w.containerID = "abc"
+	w.rank = 2
+	w.saveJournal(StateRun)
+
+	entries, err := readJournal(dir)
+	if err != nil || len(entries) != 1 {
+		t.Logf("expected one journal entry, got %+v err = %+v", entries, err)
+		t.Fail()
+		return
+	}
+	e := entries[0]
+	if e.JudgeInfo.JudgingID != 5 || e.State != StateRun || e.Rank != 2 || e.ContainerID != "abc" || e.WorkDir != w.WorkDir {
+		t.Logf("unexpected journal entry %+v", e)
+		t.Fail()
+		return
+	}
+	w.removeJournal()
+	entries, err = readJournal(dir)
+	if err != nil || len(entries) != 0 {
+		t.Logf("expected empty journal, got %+v err = %+v", entries, err)
+		t.Fail()
+		return
+	}
+}
+
+// fakeSysCPU makes a sysfs of 2 physical cores with 2 hyperthreads each,
+// like a 2C4T laptop. It is removed and SysCPURoot restored when the test ends
+func fakeSysCPU(t *testing.T) (dir string) {
+	dir, err := ioutil.TempDir("", "djudge-cpu")
+	if err != nil {
+		t.Fatalf("create temp dir error: %+v", err)
+	}
+	siblings := []string{"0,2", "1,3", "0,2", "1,3"}
+	for i, s := range siblings {
+		os.MkdirAll(filepath.Join(dir, fmt.Sprintf("cpu%d", i), "topology"), DirPerm)
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("cpu%d", i), "topology", "thread_siblings_list"), []byte(s+"\n"), FilePerm)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "online"), []byte("0-3\n"), FilePerm)
+	old := SysCPURoot
+	SysCPURoot = dir
+	t.Cleanup(func() {
+		SysCPURoot = old
+		os.RemoveAll(dir)
+	})
+	return
+}
+
+func TestDaemonDrain(t *testing.T) {
+	fakeSysCPU(t)
+	d := Daemon{MaxWorker: 2}
+	err := d.Run(context.Background())
+	if err != nil {
+		t.Logf("run daemon error: %+v", err)
+		t.Fail()
+		return
+	}
+	err = d.Drain(context.Background())
+	if err != nil {
+		t.Logf("drain idle daemon error: %+v", err)
+		t.Fail()
+		return
+	}
+}
+
+func TestDaemonIdle(t *testing.T) {
+	d := Daemon{MaxWorker: 2}
+	p := &pool{PoolConfig: config.PoolConfig{Workers: 2}, queue: make(chan Worker, 2)}
+	d.pools = []*pool{p}
+	d.freed = make(chan struct{}, 1)
+	d.WorkerState = []string{WorkerIdle, WorkerIdle}
+	d.enqueue(Worker{})
+	if d.Idle() != 1 {
+		t.Logf("expected 1 idle worker with a task queued, got %d", d.Idle())
+		t.Fail()
+	}
+	<-p.queue
+	d.setState(p, 0, WorkerJudging, true)
+	if d.Idle() != 1 || d.CurrentWorker != 1 {
+		t.Logf("expected 1 idle and 1 judging worker, got %d and %d", d.Idle(), d.CurrentWorker)
+		t.Fail()
+	}
+	d.setState(p, 0, WorkerIdle, false)
+	if d.Idle() != 2 {
+		t.Logf("expected 2 idle workers, got %d", d.Idle())
+		t.Fail()
+	}
+	select {
+	case <-d.freed:
+	default:
+		t.Logf("expected a freed worker notification")
+		t.Fail()
+	}
+
+	// Only the fast pool takes every judging, an idle slow pool fetches
+	// nothing while it is busy
+	fast := &pool{PoolConfig: config.PoolConfig{Name: "fast", Workers: 1}, queue: make(chan Worker, 2)}
+	slow := &pool{PoolConfig: config.PoolConfig{Name: "slow", Workers: 1, MinTimeLimit: 5}, queue: make(chan Worker, 2), slot: 1}
+	d.pools = []*pool{fast, slow}
+	if d.Idle() != 1 {
+		t.Logf("expected 1 judging to fetch with both pools idle, got %d", d.Idle())
+		t.Fail()
+	}
+	d.enqueue(Worker{JudgeInfo: config.JudgeInfo{TimeLimit: 1}})
+	if len(fast.queue) != 1 || d.Idle() != 0 {
+		t.Logf("expected the short judging on the fast pool and nothing to fetch, got %d queued and %d idle", len(fast.queue), d.Idle())
+		t.Fail()
+	}
+	// A long judging falls back to the fast pool while the slow one is busy
+	<-fast.queue
+	d.setState(fast, 0, WorkerJudging, true)
+	d.setState(fast, 0, WorkerIdle, false)
+	slow.busy = 1
+	d.enqueue(Worker{JudgeInfo: config.JudgeInfo{TimeLimit: 10}})
+	if len(fast.queue) != 1 || len(slow.queue) != 0 {
+		t.Logf("expected the long judging on the idle fast pool, got %d and %d queued", len(fast.queue), len(slow.queue))
+		t.Fail()
+	}
+}
+
+func TestCPUAllocator(t *testing.T) {
+	fakeSysCPU(t)
+
+	a, err := NewCPUAllocator(nil, nil)
+	if err != nil || a.Len() != 2 {
+		t.Logf("expected 2 cores, got %+v err = %+v", a, err)
+		t.Fail()
+		return
+	}
+	a, err = NewCPUAllocator(nil, []int{3})
+	if err != nil || a.Len() != 1 {
+		t.Logf("expected 1 core with cpu 3 reserved, got %+v err = %+v", a, err)
+		t.Fail()
+		return
+	}
+	cpuid, err := a.Get()
+	if err != nil || cpuid != 0 {
+		t.Logf("expected cpu 0, got %d err = %+v", cpuid, err)
+		t.Fail()
+		return
+	}
+	_, err = a.Get()
+	if err == nil {
+		t.Logf("expected no cpu left")
+		t.Fail()
+		return
+	}
+	a.Put(cpuid)
+	cpuid, err = a.Get()
+	if err != nil || cpuid != 0 {
+		t.Logf("expected cpu 0 after put, got %d err = %+v", cpuid, err)
+		t.Fail()
+		return
+	}
+	cpus := []int{3, 0}
+	_, err = NewCPUAllocator(cpus, nil)
+	if err != nil || cpus[0] != 3 || cpus[1] != 0 {
+		t.Logf("expected the cpu list left as is, got %v err = %+v", cpus, err)
+		t.Fail()
+	}
+}
+
+func TestPools(t *testing.T) {
+	fakeSysCPU(t)
+	_, err := newPools([]config.PoolConfig{{Name: "a", CPUs: []int{0}}, {Name: "b", CPUs: []int{2}}})
+	if err == nil {
+		t.Logf("expected error on pools sharing a physical core")
+		t.Fail()
+		return
+	}
+	d := Daemon{}
+	d.pools, err = newPools([]config.PoolConfig{{Name: "normal", CPUs: []int{0}}, {Name: "long", CPUs: []int{1}, MinTimeLimit: 10, RootMemory: 1024}})
+	if err != nil {
+		t.Logf("create pools error: %+v", err)
+		t.Fail()
+		return
+	}
+	if p := d.route(config.JudgeInfo{TimeLimit: 1}); p.Name != "normal" {
+		t.Logf("expected pool normal for 1s judging, got %s", p.Name)
+		t.Fail()
+	}
+	p := d.route(config.JudgeInfo{TimeLimit: 15})
+	if p.Name != "long" {
+		t.Logf("expected pool long for 15s judging, got %s", p.Name)
+		t.Fail()
+		return
+	}
+	w := Worker{rootMemory: 4096}
+	p.profile(&w)
+	if w.rootMemory != 1024 {
+		t.Logf("expected root memory of pool long, got %d", w.rootMemory)
+		t.Fail()
+	}
+}
+
+func TestMoveEntries(t *testing.T) {
+	from, err := ioutil.TempDir("", "from")
+	if err != nil {
+		t.Logf("create dir error: %+v", err)
+		t.Fail()
+		return
+	}
+	defer os.RemoveAll(from)
+	to, err := ioutil.TempDir("", "to")
+	if err != nil {
+		t.Logf("create dir error: %+v", err)
+		t.Fail()
+		return
+	}
+	defer os.RemoveAll(to)
+	os.Mkdir(filepath.Join(from, "build"), DirPerm)
+	ioutil.WriteFile(filepath.Join(from, "build", "run"), []byte("run"), FilePerm)
+	ioutil.WriteFile(filepath.Join(from, "testcase001.in"), []byte("1 2"), FilePerm)
+	err = moveEntries(from, to)
+	if err != nil {
+		t.Logf("move entries error: %+v", err)
 		t.Fail()
 		return
 	}
+	left, _ := ioutil.ReadDir(from)
+	if len(left) != 0 {
+		t.Logf("expected nothing left, got %d entries", len(left))
+		t.Fail()
+	}
+	data, err := ioutil.ReadFile(filepath.Join(to, "build", "run"))
+	if err != nil || string(data) != "run" {
+		t.Logf("expected build/run moved, got %q %v", data, err)
+		t.Fail()
+	}
+}
+
+// fakeSandbox keeps the containers in memory, the tests make them dirty
+// by hand
+type fakeSandbox struct {
+	mu         sync.Mutex
+	seq        int
+	containers map[string]*fakeContainer
+}
+
+type fakeContainer struct {
+	spec      ContainerSpec
+	running   bool
+	processes int
+	changes   map[string]bool
+	tmp       []string // Files in /tmp
+	tmpStuck  bool     // Wiping /tmp fails
+	ipc       []string // SysV IPC objects
+	ipcStuck  bool     // Removing the IPC objects fails
+}
+
+func newFakeSandbox() *fakeSandbox {
+	return &fakeSandbox{containers: make(map[string]*fakeContainer)}
+}
+
+func (f *fakeSandbox) container(id string) (c *fakeContainer, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.containers[id]
+	if !ok {
+		err = fmt.Errorf("no such container %s", id)
+	}
+	return
+}
+
+func (f *fakeSandbox) Create(ctx context.Context, spec ContainerSpec) (id string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	id = fmt.Sprintf("c%d", f.seq)
+	f.containers[id] = &fakeContainer{spec: spec, running: true, processes: 1, changes: map[string]bool{"1 /dev": true}}
+	return
+}
 
+// Exec runs nothing but the commands of the container pool on /tmp and the
+// IPC objects, the exit code is in the exec ID
+func (f *fakeSandbox) Exec(ctx context.Context, id string, user string, cmd string) (execID string, output io.ReadCloser, err error) {
+	c, err := f.container(id)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	code := 0
+	switch {
+	case cmd == wipeTmpCmd && c.tmpStuck:
+		code = 1
+	case cmd == wipeTmpCmd:
+		c.tmp = nil
+	case cmd == checkTmpCmd && len(c.tmp) > 0:
+		code = 1
+	case cmd == wipeIPCCmd && c.ipcStuck:
+		code = 1
+	case cmd == wipeIPCCmd:
+		c.ipc = nil
+	case cmd == checkIPCCmd && len(c.ipc) > 0:
+		code = 1
+	}
+	return fmt.Sprintf("e-%s-%d", id, code), ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (f *fakeSandbox) ExecInspect(ctx context.Context, execID string) (info ExecInfo, err error) {
+	fmt.Sscanf(execID[strings.LastIndex(execID, "-")+1:], "%d", &info.ExitCode)
+	return
+}
+
+func (f *fakeSandbox) Inspect(ctx context.Context, id string) (state ContainerState, err error) {
+	c, err := f.container(id)
+	if err != nil {
+		return
+	}
+	state.Running = c.running
+	return
+}
+
+func (f *fakeSandbox) SetMemory(ctx context.Context, id string, lim int64) (err error) {
+	c, err := f.container(id)
+	if err != nil {
+		return
+	}
+	c.spec.Memory = lim
+	return
+}
+
+func (f *fakeSandbox) Stop(ctx context.Context, id string) (err error) {
+	c, err := f.container(id)
+	if err != nil {
+		return
+	}
+	c.running = false
+	return
+}
+
+func (f *fakeSandbox) Remove(ctx context.Context, id string) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.containers, id)
+	return
+}
+
+func (f *fakeSandbox) List(ctx context.Context, label string, value string) (list []ContainerInfo, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, c := range f.containers {
+		if c.spec.Labels[label] == value {
+			list = append(list, ContainerInfo{ID: id, Labels: c.spec.Labels})
+		}
+	}
+	return
+}
+
+func (f *fakeSandbox) Changes(ctx context.Context, id string) (changes map[string]bool, err error) {
+	c, err := f.container(id)
+	if err != nil {
+		return
+	}
+	changes = make(map[string]bool)
+	for ch := range c.changes {
+		changes[ch] = true
+	}
+	return
+}
+
+func (f *fakeSandbox) Processes(ctx context.Context, id string) (n int, err error) {
+	c, err := f.container(id)
+	if err != nil {
+		return
+	}
+	return c.processes, nil
+}
+
+func (f *fakeSandbox) Healthy() (healthy bool, err error) {
+	return true, nil
+}
+
+func TestContainerPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandbox")
+	if err != nil {
+		t.Logf("create dir error: %+v", err)
+		t.Fail()
+		return
+	}
+	defer os.RemoveAll(dir)
+	f := newFakeSandbox()
+	cp, err := newContainerPool(f, filepath.Join(dir, "sandbox"), 1, 2)
+	if err != nil {
+		t.Logf("create container pool error: %+v", err)
+		t.Fail()
+		return
+	}
+	ctx := context.Background()
+	// Every case has its own key, as a recycled container is replaced in background
+	cases := []struct {
+		name  string
+		dirty func(fc *fakeContainer, dir string)
+		kept  bool
+	}{
+		{"clean", func(fc *fakeContainer, dir string) {}, true},
+		{"file left", func(fc *fakeContainer, dir string) {
+			ioutil.WriteFile(filepath.Join(dir, "a.out"), []byte("1"), FilePerm)
+		}, false},
+		{"process left", func(fc *fakeContainer, dir string) { fc.processes = 2 }, false},
+		{"image changed", func(fc *fakeContainer, dir string) { fc.changes["1 /tmp/x"] = true }, false},
+		{"stopped", func(fc *fakeContainer, dir string) { fc.running = false }, false},
+		{"tmp wiped", func(fc *fakeContainer, dir string) { fc.tmp = []string{"a.txt"} }, true},
+		{"tmp left", func(fc *fakeContainer, dir string) {
+			fc.tmp = []string{"a.txt"}
+			fc.tmpStuck = true
+		}, false},
+		{"ipc removed", func(fc *fakeContainer, dir string) { fc.ipc = []string{"shm 0"} }, true},
+		{"ipc left", func(fc *fakeContainer, dir string) {
+			fc.ipc = []string{"shm 0"}
+			fc.ipcStuck = true
+		}, false},
+	}
+	for i, cs := range cases {
+		key := warmKey{image: "img", cpu: i, memory: 1024, pids: 64}
+		cp.warm(ctx, key)
+		c, err := cp.get(ctx, key)
+		if err != nil {
+			t.Logf("%s: get error: %+v", cs.name, err)
+			t.Fail()
+			continue
+		}
+		f.SetMemory(ctx, c.id, 4096)
+		fc, _ := f.container(c.id)
+		cs.dirty(fc, c.dir)
+		cp.put(ctx, c)
+		fc, _ = f.container(c.id)
+		if cs.kept && (fc == nil || fc.spec.Memory != 1024) {
+			t.Logf("%s: expected container kept with memory reset, got %+v", cs.name, fc)
+			t.Fail()
+		}
+		if !cs.kept && fc != nil {
+			t.Logf("%s: expected container recycled", cs.name)
+			t.Fail()
+		}
+	}
+	// Recycled after max uses
+	key := warmKey{image: "img", cpu: 0, memory: 1024, pids: 64}
+	c, _ := cp.get(ctx, key)
+	if c == nil || c.uses != 2 {
+		t.Logf("expected the kept container used twice, got %+v", c)
+		t.Fail()
+		return
+	}
+	cp.put(ctx, c)
+	if fc, _ := f.container(c.id); fc != nil {
+		t.Logf("expected container recycled after max uses")
+		t.Fail()
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwd := filepath.Join(dir, "passwd")
+	ioutil.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/bash\njudge:x:1000:1001::/home/judge:/bin/sh\nbad:x:a:b::/:/bin/sh\n"), FilePerm)
+	cases := []struct {
+		name string
+		uid  int
+		gid  int
+		ok   bool
+	}{
+		{"root", 0, 0, true},
+		{"judge", 1000, 1001, true},
+		{"bad", 0, 0, false},
+		{"nobody", 0, 0, false},
+	}
+	for _, cs := range cases {
+		uid, gid, err := lookupUser(passwd, cs.name)
+		if (err == nil) != cs.ok || (cs.ok && (uid != cs.uid || gid != cs.gid)) {
+			t.Logf("lookup %s expected %d:%d ok %v, got %d:%d %+v", cs.name, cs.uid, cs.gid, cs.ok, uid, gid, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestSeccompFilter(t *testing.T) {
+	denied, err := lookupSyscalls(DefaultDeniedSyscalls)
+	if err != nil {
+		t.Logf("lookup default denied syscalls error: %+v", err)
+		t.Fail()
+		return
+	}
+	prog, err := seccompFilter(denied)
+	if err != nil {
+		t.Skip(err)
+	}
+	// Arch check, x32 check, two per denied syscall, clone, clone3 and the allow
+	if len(prog) != 6+2*len(denied)+7+1 {
+		t.Logf("expected %d instructions, got %d", 6+2*len(denied)+7+1, len(prog))
+		t.Fail()
+	}
+	if prog[len(prog)-1].K != seccompRetAllow || prog[7].K != seccompRetKill {
+		t.Logf("expected the filter to kill denied syscalls and allow the rest, got %+v", prog)
+		t.Fail()
+	}
+	clone := prog[6+2*len(denied):]
+	if clone[0].K != unix.SYS_CLONE || clone[2].K != NamespaceCloneFlags || clone[3].K != seccompRetKill || clone[6].K != seccompRetErrno|uint32(unix.ENOSYS) {
+		t.Logf("expected clone with namespace flags killed and clone3 failing, got %+v", clone)
+		t.Fail()
+	}
+}
+
+func TestDockerSeccomp(t *testing.T) {
+	denied, _ := profileSpec("")
+	profile, err := dockerSeccomp(denied)
+	if err != nil {
+		t.Logf("build profile error %+v", err)
+		t.FailNow()
+	}
+	for _, want := range []string{
+		`"names":["clone"],"action":"SCMP_ACT_KILL_PROCESS","args":[{"index":0,"value":268435456,"valueTwo":268435456,"op":"SCMP_CMP_MASKED_EQ"}]`,
+		`"names":["clone3"],"action":"SCMP_ACT_ERRNO","errnoRet":38`,
+		`"fsopen"`, `"io_uring_setup"`, `"personality"`,
+	} {
+		if !strings.Contains(profile, want) {
+			t.Logf("expected %s in the profile %s", want, profile)
+			t.Fail()
+		}
+	}
+	// A profile denying clone3 kills it instead
+	profile, _ = dockerSeccomp(append(denied, "clone3"))
+	if strings.Contains(profile, "SCMP_ACT_ERRNO") {
+		t.Logf("expected no ENOSYS rule for a denied clone3, got %s", profile)
+		t.Fail()
+	}
+}
+
+func TestProfileSpec(t *testing.T) {
+	config.GlobalConfig.Security = map[string]config.SecurityProfile{
+		"java": {Deny: []string{"socket"}, Allow: []string{"ptrace"}, CapAdd: []string{"SYS_NICE"}},
+	}
+	defer func() { config.GlobalConfig.Security = nil }()
+	if securityProfile("java") != "java" || securityProfile("cpp") != "" {
+		t.Logf("expected java to have its profile and cpp the default")
+		t.Fail()
+	}
+	denied, caps := profileSpec("")
+	if len(denied) != len(DefaultDeniedSyscalls) || len(caps) != len(DefaultCaps) {
+		t.Logf("expected the default profile, got %v %v", denied, caps)
+		t.Fail()
+	}
+	denied, caps = profileSpec("java")
+	has := func(list []string, s string) bool {
+		for _, v := range list {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+	if has(denied, "ptrace") || !has(denied, "socket") || !has(denied, "mount") || !has(caps, "SYS_NICE") {
+		t.Logf("expected the java profile, got %v %v", denied, caps)
+		t.Fail()
+	}
+	if _, err := lookupCaps(caps); err != nil {
+		t.Logf("lookup caps error: %+v", err)
+		t.Fail()
+	}
+	if _, err := lookupSyscalls([]string{"no_such_syscall"}); err == nil {
+		t.Logf("expected unknown syscall error")
+		t.Fail()
+	}
+}
+
+func TestRunAs(t *testing.T) {
+	cases := []struct {
+		user string
+		want string
+	}{
+		{"root", "/usr/local/bin/djudge-wait /sandbox/run.status 'root' 64 ./program"},
+		{"", "/usr/local/bin/djudge-wait /sandbox/run.status 'root' 64 ./program"},
+		{"judge", "/usr/local/bin/djudge-wait /sandbox/run.status 'judge' 64 ./program"},
+	}
+	for _, cs := range cases {
+		w := Worker{RunUser: cs.user}
+		w.JudgeInfo.OutputLimit = 64
+		if got := w.runAs("./program"); got != cs.want {
+			t.Logf("run as %q expected %s, got %s", cs.user, cs.want, got)
+			t.Fail()
+		}
+	}
+}
+
+func TestWaitStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "djudge-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := Worker{WorkDir: dir}
+	cases := []struct {
+		status   string
+		exitcode int
+		signal   int
+		ok       bool
+	}{
+		{"", 2, 0, true}, // Never started
+		{"exited 153\n", 153, 0, true},
+		{"signaled 25\n", 128 + 25, 25, true},
+		{"stopped 1\n", 0, 0, false},
+	}
+	for _, cs := range cases {
+		os.Remove(filepath.Join(dir, RunStatus))
+		if cs.status != "" {
+			ioutil.WriteFile(filepath.Join(dir, RunStatus), []byte(cs.status), FilePerm)
+		}
+		exitcode, signal, err := w.waitStatus(2)
+		if (err == nil) != cs.ok || (cs.ok && (exitcode != cs.exitcode || signal != cs.signal)) {
+			t.Logf("status %q expected exit %d signal %d ok %v, got %d %d %+v", cs.status, cs.exitcode, cs.signal, cs.ok, exitcode, signal, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prefetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testdir := filepath.Join(dir, "testcases")
+	os.MkdirAll(testdir, DirPerm)
+	for i := 1; i <= 3; i++ {
+		ioutil.WriteFile(filepath.Join(testdir, fmt.Sprintf("%d.in", i)), []byte(fmt.Sprintf("in %d", i)), FilePerm)
+		ioutil.WriteFile(filepath.Join(testdir, fmt.Sprintf("%d.out", i)), []byte(fmt.Sprintf("out %d", i)), FilePerm)
+	}
+	s, err := server.NewLocal(config.JudgeInfo{JudgingID: 1}, "", testdir, "", ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := config.GlobalConfig.PrefetchWorkers
+	config.GlobalConfig.PrefetchWorkers = 2
+	defer func() { config.GlobalConfig.PrefetchWorkers = old }()
+
+	w := Worker{judgeServer: s, WorkDir: filepath.Join(dir, "judging")}
+	os.MkdirAll(w.WorkDir, DirPerm)
+	ctx := context.Background()
+	w.startPrefetch(ctx)
+	if w.prefetch == nil || len(w.prefetch.files) != 3 {
+		t.Fatalf("expected 3 testcases prefetched, got %+v", w.prefetch)
+	}
+	// A broken prefetch is downloaded again
+	<-w.prefetch.files[2].done
+	os.Remove(w.prefetch.files[2].input)
+	for i := 1; ; i++ {
+		tinfo, ok, err := s.FetchTestcase(ctx, w.JudgeInfo)
+		if err != nil || !ok {
+			break
+		}
+		err = w.fetchTestcase(ctx, tinfo)
+		if err != nil {
+			t.Logf("fetch testcase %d error %+v", i, err)
+			t.Fail()
+			continue
+		}
+		for _, ext := range []string{"in", "out"} {
+			data, _ := ioutil.ReadFile(filepath.Join(w.WorkDir, fmt.Sprintf("testcase%03d.%s", i, ext)))
+			if string(data) != fmt.Sprintf("%s %d", ext, i) {
+				t.Logf("testcase %d %s expected %q, got %q", i, ext, fmt.Sprintf("%s %d", ext, i), data)
+				t.Fail()
+			}
+		}
+	}
+	w.stopPrefetch()
+	if _, err := os.Stat(w.WorkDir + PrefetchDirSuffix); !os.IsNotExist(err) {
+		t.Logf("expected prefetch dir removed, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestParseCgroup(t *testing.T) {
+	v1 := "12:memory:/docker/abc\n11:cpu,cpuacct:/docker/abc\n1:name=systemd:/docker/abc\n"
+	cg, err := parseCgroup(strings.NewReader(v1))
+	if err != nil || cg.v2 || cg.memory != CgroupRoot+"/memory/docker/abc" || cg.cpuacct != CgroupRoot+"/cpu,cpuacct/docker/abc" || !cg.peak {
+		t.Logf("parse v1 cgroup got %+v err = %+v", cg, err)
+		t.Fail()
+	}
+	// A container split already
+	v2 := "0::/system.slice/docker-abc.scope/" + CgroupInit + "\n"
+	cg, err = parseCgroup(strings.NewReader(v2))
+	if err != nil || !cg.v2 || cg.memory != CgroupRoot+"/system.slice/docker-abc.scope" || cg.cpuacct != cg.memory {
+		t.Logf("parse v2 cgroup got %+v err = %+v", cg, err)
+		t.Fail()
+	}
+	_, err = parseCgroup(strings.NewReader("1:name=systemd:/\n"))
+	if err == nil {
+		t.Logf("expected error without memory cgroup")
+		t.Fail()
+	}
+}
+
+func TestInnermostPid(t *testing.T) {
+	cases := map[string]int{
+		"Name:\tsh\nNSpid:\t4242\t17\nPPid:\t1\n": 17,
+		"Name:\tsh\nNSpid:\t4242\n":               4242,
+		"Name:\tsh\n":                             0,
+	}
+	for status, pid := range cases {
+		if got := innermostPid(status); got != pid {
+			t.Logf("expected pid %d of %q, got %d", pid, status, got)
+			t.Fail()
+		}
+	}
+}
+
+func TestCgroupRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "djudge-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cg := &cgroup{v2: true, memory: dir, cpuacct: dir}
+	run, err := cg.newRun(1 << 20)
+	if err != nil {
+		t.Fatalf("create run cgroup error %+v", err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, CgroupRun, "memory.max"))
+	if string(data) != "1048576" || run.peak {
+		t.Logf("expected memory.max 1048576 and no peak, got %q %v", data, run.peak)
+		t.Fail()
+	}
+	// Sampled without memory.peak
+	for _, cur := range []string{"100", "300", "200"} {
+		ioutil.WriteFile(filepath.Join(run.memory, "memory.current"), []byte(cur+"\n"), FilePerm)
+		run.sample()
+	}
+	ioutil.WriteFile(filepath.Join(run.memory, "cpu.stat"), []byte("usage_usec 1500\nuser_usec 1000\n"), FilePerm)
+	ioutil.WriteFile(filepath.Join(run.memory, "memory.events"), []byte("oom 1\noom_kill 1\n"), FilePerm)
+	mem, err := run.peakMemory()
+	if err != nil || mem != 300 {
+		t.Logf("expected sampled peak 300, got %d err = %+v", mem, err)
+		t.Fail()
+	}
+	cpu, err := run.cpuUsage()
+	if err != nil || cpu != 1500000 {
+		t.Logf("expected cpu 1500000ns, got %d err = %+v", cpu, err)
+		t.Fail()
+	}
+	oom, err := run.oomKills()
+	if err != nil || oom != 1 {
+		t.Logf("expected 1 oom kill, got %d err = %+v", oom, err)
+		t.Fail()
+	}
+	ioutil.WriteFile(filepath.Join(run.memory, "memory.peak"), []byte("4096\n"), FilePerm)
+	run.peak = true
+	mem, err = run.peakMemory()
+	if err != nil || mem != 4096 {
+		t.Logf("expected peak 4096, got %d err = %+v", mem, err)
+		t.Fail()
+	}
+}
+
+func TestInteractMeasured(t *testing.T) {
+	dir, err := ioutil.TempDir("", "djudge-interact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := Worker{WorkDir: dir, RunUser: "judge"}
+	cmd, err := w.interactCmd()
+	if err != nil {
+		t.Fatalf("interact command error %+v", err)
+	}
+	// Only the program is measured, not the interactor or tee
+	program := measured(w.runAs("./program"))
+	if strings.Count(cmd, MeasurePid) != 1 || !strings.Contains(cmd, program+" < execdir/to-program") {
+		t.Logf("expected only the program measured, got %s", cmd)
+		t.Fail()
+	}
+}
+
+// fakeDocker records the calls of DockerClient to the docker API
+type fakeDocker struct {
+	dockerAPI // The calls not faked panic
+	pingErr   error
+	topErr    error
+	created   *container.HostConfig
+	started   []string
+	execCmd   []string
+	removed   container.RemoveOptions
+	listed    container.ListOptions
+}
+
+func (f *fakeDocker) Ping(ctx context.Context) (types.Ping, error) {
+	return types.Ping{}, f.pingErr
+}
+
+func (f *fakeDocker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	f.created = hostConfig
+	return container.CreateResponse{ID: "c1"}, nil
+}
+
+func (f *fakeDocker) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	f.started = append(f.started, containerID)
+	return nil
+}
+
+func (f *fakeDocker) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	f.removed = options
+	return nil
+}
+
+func (f *fakeDocker) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	f.listed = options
+	return []container.Summary{{ID: "c1", Labels: map[string]string{"djudge": "judge-01"}}}, nil
+}
+
+func (f *fakeDocker) ContainerDiff(ctx context.Context, containerID string) ([]container.FilesystemChange, error) {
+	return []container.FilesystemChange{{Kind: 1, Path: "/tmp/x"}}, nil
+}
+
+func (f *fakeDocker) ContainerTop(ctx context.Context, containerID string, arguments []string) (container.TopResponse, error) {
+	return container.TopResponse{Processes: [][]string{{"1"}, {"2"}}}, f.topErr
+}
+
+func (f *fakeDocker) ContainerExecCreate(ctx context.Context, containerID string, options container.ExecOptions) (container.ExecCreateResponse, error) {
+	f.execCmd = options.Cmd
+	return container.ExecCreateResponse{ID: "e1"}, nil
+}
+
+func (f *fakeDocker) ContainerExecAttach(ctx context.Context, execID string, config container.ExecAttachOptions) (types.HijackedResponse, error) {
+	conn, peer := net.Pipe()
+	peer.Close()
+	return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(strings.NewReader("hello"))}, nil
+}
+
+func (f *fakeDocker) ContainerExecInspect(ctx context.Context, execID string) (container.ExecInspect, error) {
+	return container.ExecInspect{ExecID: execID, ExitCode: 3}, nil
+}
+
+func (f *fakeDocker) Close() error {
+	return nil
+}
+
+func TestDockerSandbox(t *testing.T) {
+	fake := &fakeDocker{}
+	d := &DockerClient{dial: func(ctx context.Context) (dockerAPI, error) { return fake, nil }}
+	ctx := context.Background()
+	if _, err := d.client(ctx); err != nil {
+		t.Logf("connect error %+v", err)
+		t.FailNow()
+	}
+
+	id, err := d.Create(ctx, ContainerSpec{Image: "d-judge", Dir: "/judge/c1", CPU: 2, Memory: 1 << 30, Pids: 64})
+	if err != nil || id != "c1" || len(fake.started) != 1 || fake.started[0] != "c1" {
+		t.Logf("create got %s, started %v, error %+v", id, fake.started, err)
+		t.Fail()
+	}
+	if h := fake.created; h == nil || !h.ReadonlyRootfs || h.CpusetCpus != "2" || h.MemorySwap != 1<<30 || len(h.SecurityOpt) != 1 || !strings.HasPrefix(h.SecurityOpt[0], "seccomp=") {
+		t.Logf("host config %+v", h)
+		t.Fail()
+	}
+
+	execID, output, err := d.Exec(ctx, id, "root", "echo hello")
+	if err != nil {
+		t.Logf("exec error %+v", err)
+		t.FailNow()
+	}
+	data, _ := ioutil.ReadAll(output)
+	output.Close()
+	if string(data) != "hello" || strings.Join(fake.execCmd, " ") != "/bin/bash -c echo hello" {
+		t.Logf("exec got %q, cmd %q", data, fake.execCmd)
+		t.Fail()
+	}
+	info, err := d.ExecInspect(ctx, execID)
+	if err != nil || info.ExitCode != 3 {
+		t.Logf("exec inspect got %+v, error %+v", info, err)
+		t.Fail()
+	}
+
+	list, err := d.List(ctx, "djudge", "judge-01")
+	if err != nil || len(list) != 1 || list[0].ID != "c1" || !fake.listed.All || !fake.listed.Filters.ExactMatch("label", "djudge=judge-01") {
+		t.Logf("list got %+v, options %+v, error %+v", list, fake.listed, err)
+		t.Fail()
+	}
+	changes, err := d.Changes(ctx, id)
+	if err != nil || !changes["1 /tmp/x"] {
+		t.Logf("changes got %v, error %+v", changes, err)
+		t.Fail()
+	}
+	n, err := d.Processes(ctx, id)
+	if err != nil || n != 2 {
+		t.Logf("processes got %d, error %+v", n, err)
+		t.Fail()
+	}
+	err = d.Remove(ctx, id)
+	if err != nil || !fake.removed.Force {
+		t.Logf("remove options %+v, error %+v", fake.removed, err)
+		t.Fail()
+	}
+}
+
+func TestDockerReconnect(t *testing.T) {
+	fake := &fakeDocker{}
+	dials := 0
+	d := &DockerClient{dial: func(ctx context.Context) (dockerAPI, error) {
+		dials++
+		return fake, nil
+	}}
+	ctx := context.Background()
+	d.client(ctx)
+
+	// The workers share the client while docker is healthy
+	d.Ping(ctx)
+	d.Processes(ctx, "c1")
+	if healthy, _ := d.Healthy(); !healthy || dials != 1 {
+		t.Logf("healthy %v after %d dials, want one", healthy, dials)
+		t.Fail()
+	}
+
+	fake.pingErr = fmt.Errorf("docker is gone")
+	err := d.Ping(ctx)
+	healthy, why := d.Healthy()
+	if err == nil || healthy || why == nil {
+		t.Logf("ping got %v, healthy %v because %v", err, healthy, why)
+		t.Fail()
+	}
+
+	// Reconnected by the next call once docker is back
+	fake.pingErr = nil
+	err = d.Ping(ctx)
+	healthy, why = d.Healthy()
+	if err != nil || !healthy || why != nil || dials != 2 {
+		t.Logf("ping got %v, healthy %v because %v after %d dials", err, healthy, why, dials)
+		t.Fail()
+	}
+
+	// A container operation failing to reach docker marks it unhealthy too,
+	// other failures do not
+	fake.topErr = fmt.Errorf("no such container")
+	d.Processes(ctx, "c1")
+	if healthy, _ = d.Healthy(); !healthy {
+		t.Logf("unhealthy after a failed operation")
+		t.Fail()
+	}
+	fake.topErr = client.ErrorConnectionFailed("unix:///var/run/docker.sock")
+	d.Processes(ctx, "c1")
+	if healthy, _ = d.Healthy(); healthy {
+		t.Logf("healthy after a connection failure")
+		t.Fail()
+	}
+	fake.topErr = nil
+	_, err = d.Processes(ctx, "c1")
+	if healthy, _ = d.Healthy(); err != nil || !healthy || dials != 3 {
+		t.Logf("processes got %v, healthy %v after %d dials", err, healthy, dials)
+		t.Fail()
+	}
+}
+
+func TestRunVerdict(t *testing.T) {
+	cpulim := time.Second
+	cases := []struct {
+		info     runinfo
+		exitcode int
+		signal   int
+		verdict  string
+	}{
+		{runinfo{}, 0, 0, ""},
+		{runinfo{}, 1, 0, config.ResRE},
+		{runinfo{}, 128 + 11, 11, config.ResRE},
+		{runinfo{}, 128 + 31, 31, config.ResRF},
+		{runinfo{}, 128 + 25, 25, config.ResOLE},
+		// Exiting with the code of a signal is no signal
+		{runinfo{}, 128 + 25, 0, config.ResRE},
+		{runinfo{}, 128 + 31, 0, config.ResRE},
+		{runinfo{outputexceed: true}, 128 + 31, 31, config.ResOLE},
+		{runinfo{usedcpu: int64(2 * time.Second)}, 0, 0, config.ResTLE},
+		{runinfo{timeexceed: true, outputexceed: true}, 128 + 9, 9, config.ResTLE},
+		// Killed by the OOM killer after running too long
+		{runinfo{memexceed: true, timeexceed: true, outputexceed: true}, 128 + 9, 9, config.ResMLE},
+	}
+	for _, c := range cases {
+		verdict := runVerdict(c.info, cpulim, c.exitcode, c.signal)
+		if verdict != c.verdict {
+			t.Logf("%+v exit %d signal %d got %q, want %q", c.info, c.exitcode, c.signal, verdict, c.verdict)
+			t.Fail()
+		}
+	}
+}
+
+func TestTimeLimits(t *testing.T) {
+	saved := config.GlobalConfig
+	t.Cleanup(func() { config.GlobalConfig = saved })
+	w := Worker{}
+	w.JudgeInfo.TimeLimit = 2
+
+	// A soft CPU limit of the time limit and twice as long wall time by default
+	config.GlobalConfig.CPUTimeFactor = 0
+	config.GlobalConfig.WallTimeFactor = 0
+	cpulim, walllim := w.timeLimits()
+	if cpulim != 2*time.Second || walllim != 4*time.Second {
+		t.Logf("default limits got %s cpu %s wall", cpulim, walllim)
+		t.Fail()
+	}
+
+	config.GlobalConfig.CPUTimeFactor = 1.5
+	config.GlobalConfig.WallTimeFactor = 3
+	cpulim, walllim = w.timeLimits()
+	if cpulim != 3*time.Second || walllim != 6*time.Second {
+		t.Logf("limits got %s cpu %s wall", cpulim, walllim)
+		t.Fail()
+	}
+
+	// A fractional limit is kept as is
+	w.JudgeInfo.TimeLimit = 0.5
+	cpulim, walllim = w.timeLimits()
+	if cpulim != 750*time.Millisecond || walllim != 1500*time.Millisecond {
+		t.Logf("fractional limits got %s cpu %s wall", cpulim, walllim)
+		t.Fail()
+	}
 }
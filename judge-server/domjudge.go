@@ -0,0 +1,415 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/VOID001/D-judge/config"
+	"github.com/VOID001/D-judge/downloader"
+	"github.com/VOID001/D-judge/request"
+	"github.com/pkg/errors"
+)
+
+// DOMjudge speaks the judgehost API of DOMjudge v7 and later (api/v4),
+// endpoint_url should point to the api root, e.g. http://domjudge/api/v4
+type DOMjudge struct {
+	mu sync.Mutex
+	// Testcases of the judgings in progress, DOMjudge sends all testcases with
+	// the judging, so we hand them out one by one in rank order
+	testcases map[int64][]config.TestcaseInfo
+}
+
+// domjudgeJudging is the judging payload of next-judging, DOMjudge may
+// encode numbers as strings so use json.Number here
+type domjudgeJudging struct {
+	SubmitID            json.Number                 `json:"submitid"`
+	ContestID           json.Number                 `json:"cid"`
+	TeamID              json.Number                 `json:"teamid"`
+	ProblemID           json.Number                 `json:"probid"`
+	JudgingID           json.Number                 `json:"judgingid"`
+	Language            string                      `json:"langid"`
+	TimeLimit           json.Number                 `json:"maxruntime"`
+	MemLimit            json.Number                 `json:"memlimit"`
+	OutputLimit         json.Number                 `json:"outputlimit"`
+	CompileScript       string                      `json:"compile_script"`
+	CompileScriptMD5Sum string                      `json:"compile_script_md5sum"`
+	Run                 string                      `json:"run"`
+	RunMD5Sum           string                      `json:"run_md5sum"`
+	Compare             string                      `json:"compare"`
+	CompareMD5Sum       string                      `json:"compare_md5sum"`
+	CompareArgs         string                      `json:"compare_args"`
+	CombinedRunCompare  json.RawMessage             `json:"combined_run_compare"`
+	Testcases           map[string]domjudgeTestcase `json:"testcases"`
+}
+
+type domjudgeTestcase struct {
+	TestcaseID   json.Number `json:"testcaseid"`
+	Rank         json.Number `json:"rank"`
+	MD5SumInput  string      `json:"md5sum_input"`
+	MD5SumOutput string      `json:"md5sum_output"`
+	Hash         string      `json:"testcase_hash"`
+	JudgeTaskID  json.Number `json:"judgetaskid"`
+}
+
+type domjudgeRun struct {
+	JudgeTaskID  int64  `json:"judgetaskid,omitempty"`
+	TestcaseID   int64  `json:"testcaseid"`
+	RunResult    string `json:"runresult"`
+	RunTime      string `json:"runtime"`
+	OutputRun    string `json:"output_run"`
+	OutputError  string `json:"output_error"`
+	OutputSystem string `json:"output_system"`
+	OutputDiff   string `json:"output_diff"`
+}
+
+// toInt parse the possibly empty number, empty number is 0
+func toInt(n json.Number) (i int64, err error) {
+	if n == "" {
+		return
+	}
+	i, err = strconv.ParseInt(n.String(), 10, 64)
+	return
+}
+
+func (j *domjudgeJudging) judgeInfo() (jinfo config.JudgeInfo, tcs []config.TestcaseInfo, err error) {
+	ids := []*int64{&jinfo.SubmitID, &jinfo.ContestID, &jinfo.TeamID, &jinfo.ProblemID, &jinfo.JudgingID, &jinfo.MemLimit, &jinfo.OutputLimit}
+	nums := []json.Number{j.SubmitID, j.ContestID, j.TeamID, j.ProblemID, j.JudgingID, j.MemLimit, j.OutputLimit}
+	for i := range ids {
+		*ids[i], err = toInt(nums[i])
+		if err != nil {
+			err = errors.Wrap(err, "parse judging error")
+			return
+		}
+	}
+	// DOMjudge time limit can be fractional
+	jinfo.TimeLimit, err = strconv.ParseFloat(j.TimeLimit.String(), 64)
+	if err != nil {
+		err = errors.Wrap(err, "parse judging error")
+		return
+	}
+	jinfo.Language = j.Language
+	jinfo.BuildZip = j.CompileScript
+	jinfo.BuildZipMD5 = j.CompileScriptMD5Sum
+	jinfo.RunZip = j.Run
+	jinfo.RunZipMD5 = j.RunMD5Sum
+	jinfo.CompareZip = j.Compare
+	jinfo.CompareZipMD5 = j.CompareMD5Sum
+	jinfo.CompareArgs = j.CompareArgs
+	// For interactive problems the run executable of DOMjudge is the
+	// interactor, we run it as the compare executable
+	switch string(j.CombinedRunCompare) {
+	case "true", "1", `"1"`, `"true"`:
+		jinfo.CombinedRunCompare = true
+		jinfo.CompareZip = j.Run
+		jinfo.CompareZipMD5 = j.RunMD5Sum
+	}
+
+	for _, tc := range j.Testcases {
+		tinfo := config.TestcaseInfo{
+			ProblemID:    jinfo.ProblemID,
+			MD5SumInput:  tc.MD5SumInput,
+			MD5SumOutput: tc.MD5SumOutput,
+			Hash:         tc.Hash,
+		}
+		ids := []*int64{&tinfo.TestcaseID, &tinfo.Rank, &tinfo.JudgeTaskID}
+		nums := []json.Number{tc.TestcaseID, tc.Rank, tc.JudgeTaskID}
+		for i := range ids {
+			*ids[i], err = toInt(nums[i])
+			if err != nil {
+				err = errors.Wrap(err, "parse judging testcase error")
+				return
+			}
+		}
+		tcs = append(tcs, tinfo)
+	}
+	sort.Slice(tcs, func(a, b int) bool { return tcs[a].Rank < tcs[b].Rank })
+	return
+}
+
+func (s *DOMjudge) Register(ctx context.Context) (err error) {
+	// The response is the list of unfinished judgings of this host, DOMjudge
+	// will give them out again so just ignore it here
+	err = request.Do(ctx, http.MethodPost, "/judgehosts", url.Values{"hostname": {config.GlobalConfig.HostName}}, request.TypeForm, nil)
+	if err != nil {
+		err = errors.Wrap(err, "register judgehost error")
+		return
+	}
+	return
+}
+
+func (s *DOMjudge) SetActive(ctx context.Context, active bool) (err error) {
+	body := map[string]bool{"active": active}
+	err = request.Do(ctx, http.MethodPut, fmt.Sprintf("/judgehosts/%s", url.PathEscape(config.GlobalConfig.HostName)), body, request.TypeJSON, nil)
+	if err != nil {
+		err = errors.Wrap(err, "set judgehost active error")
+		return
+	}
+	return
+}
+
+func (s *DOMjudge) FetchJudging(ctx context.Context) (jinfo config.JudgeInfo, ok bool, err error) {
+	var raw json.RawMessage
+	err = request.Do(ctx, http.MethodPost, fmt.Sprintf("/judgehosts/next-judging/%s", url.PathEscape(config.GlobalConfig.HostName)), nil, "", &raw)
+	if err != nil {
+		err = errors.Wrap(err, "fetch judging error")
+		return
+	}
+	// When there is nothing to judge, DOMjudge returns an empty body, "" or null
+	switch string(raw) {
+	case "", `""`, "null", "[]":
+		return
+	}
+	j := domjudgeJudging{}
+	err = json.Unmarshal(raw, &j)
+	if err != nil {
+		err = errors.Wrap(err, "fetch judging error: json decode error")
+		return
+	}
+	if j.JudgingID == "" {
+		return
+	}
+	jinfo, tcs, err := j.judgeInfo()
+	if err != nil {
+		err = errors.Wrap(err, "fetch judging error")
+		return
+	}
+	s.mu.Lock()
+	if s.testcases == nil {
+		s.testcases = make(map[int64][]config.TestcaseInfo)
+	}
+	s.testcases[jinfo.JudgingID] = tcs
+	s.mu.Unlock()
+	ok = true
+	return
+}
+
+func (s *DOMjudge) FetchTestcase(ctx context.Context, jinfo config.JudgeInfo) (tinfo config.TestcaseInfo, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tcs, found := s.testcases[jinfo.JudgingID]
+	if !found {
+		err = errors.New(fmt.Sprintf("fetch testcase error: judging %d not found", jinfo.JudgingID))
+		return
+	}
+	if len(tcs) == 0 {
+		delete(s.testcases, jinfo.JudgingID)
+		return
+	}
+	tinfo = tcs[0]
+	s.testcases[jinfo.JudgingID] = tcs[1:]
+	ok = true
+	return
+}
+
+func (s *DOMjudge) finish(jinfo config.JudgeInfo) {
+	s.mu.Lock()
+	delete(s.testcases, jinfo.JudgingID)
+	s.mu.Unlock()
+}
+
+func (s *DOMjudge) ListTestcases(ctx context.Context, jinfo config.JudgeInfo) (tinfos []config.TestcaseInfo, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tcs, found := s.testcases[jinfo.JudgingID]
+	if !found {
+		err = errors.New(fmt.Sprintf("list testcases error: judging %d not found", jinfo.JudgingID))
+		return
+	}
+	tinfos = append(tinfos, tcs...)
+	ok = true
+	return
+}
+
+func (s *DOMjudge) FetchTestcaseFile(ctx context.Context, tinfo config.TestcaseInfo, kind string, dest string) (err error) {
+	d := downloader.Downloader{
+		URL:          fmt.Sprintf("/testcases/%d/file/%s", tinfo.TestcaseID, kind),
+		Destination:  dest,
+		SkipMD5Check: false,
+		UseCache:     true,
+	}
+	switch kind {
+	case TestcaseInput:
+		d.FileName = fmt.Sprintf("%d.in", tinfo.TestcaseID)
+		d.MD5 = tinfo.MD5SumInput
+	case TestcaseOutput:
+		d.FileName = fmt.Sprintf("%d.out", tinfo.TestcaseID)
+		d.MD5 = tinfo.MD5SumOutput
+	default:
+		err = errors.New(fmt.Sprintf("fetch testcase file error: unknown kind %s", kind))
+		return
+	}
+	err = d.Do(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "fetch testcase file error")
+		return
+	}
+	return
+}
+
+func (s *DOMjudge) FetchExecutable(ctx context.Context, execid string, md5sum string, dest string) (err error) {
+	d := downloader.Downloader{
+		URL:          fmt.Sprintf("/executables/%s", url.PathEscape(execid)),
+		FileName:     execid,
+		Destination:  dest,
+		SkipMD5Check: false,
+		MD5:          md5sum,
+		UseCache:     true,
+	}
+	err = d.Do(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "fetch executable error")
+		return
+	}
+	return
+}
+
+func (s *DOMjudge) FetchSubmission(ctx context.Context, jinfo config.JudgeInfo, dir string) (filename string, err error) {
+	files := []struct {
+		FileName string `json:"filename"`
+		Source   string `json:"source"`
+	}{}
+	err = request.Do(ctx, http.MethodGet, fmt.Sprintf("/contests/%d/submissions/%d/source-code", jinfo.ContestID, jinfo.SubmitID), nil, "", &files)
+	if err != nil {
+		err = errors.Wrap(err, "fetch submission error")
+		return
+	}
+	if len(files) == 0 {
+		err = errors.New("fetch submission error: no submission file")
+		return
+	}
+	// Write all files, the first one is the one to compile
+	for _, f := range files {
+		data, er := base64.StdEncoding.DecodeString(f.Source)
+		if er != nil {
+			err = errors.Wrap(er, "fetch submission error")
+			return
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, filepath.Base(f.FileName)), data, downloader.FilePerm)
+		if err != nil {
+			err = errors.Wrap(err, "fetch submission error")
+			return
+		}
+	}
+	filename = filepath.Base(files[0].FileName)
+	return
+}
+
+func (s *DOMjudge) CompileResult(ctx context.Context, jinfo config.JudgeInfo, success bool, output string) (err error) {
+	info := make(url.Values)
+
+	info["compile_success"] = []string{"0"}
+	if success {
+		info["compile_success"] = []string{"1"}
+	}
+	info["output_compile"] = []string{base64.StdEncoding.EncodeToString([]byte(output))}
+
+	err = request.Do(ctx, http.MethodPut, fmt.Sprintf("/judgehosts/update-judging/%s/%d", url.PathEscape(config.GlobalConfig.HostName), jinfo.JudgingID), info, request.TypeForm, nil)
+	if err != nil {
+		err = errors.Wrap(err, "put compile result error")
+		return
+	}
+	if !success {
+		s.finish(jinfo)
+	}
+	return
+}
+
+func (s *DOMjudge) PostRun(ctx context.Context, jinfo config.JudgeInfo, result config.RunResult) (err error) {
+	run := domjudgeRun{
+		JudgeTaskID:  result.JudgeTaskID,
+		TestcaseID:   result.TestcaseID,
+		RunResult:    mapVerdict(domjudgeVerdicts, result.RunResult),
+		RunTime:      fmt.Sprintf("%f", result.RunTime),
+		OutputRun:    base64.StdEncoding.EncodeToString([]byte(result.OutputRun)),
+		OutputError:  base64.StdEncoding.EncodeToString([]byte(result.OutputError)),
+		OutputSystem: base64.StdEncoding.EncodeToString([]byte(result.OutputSystem)),
+		OutputDiff:   base64.StdEncoding.EncodeToString([]byte(result.OutputDiff)),
+	}
+	// The batch is sent as a JSON encoded string, the same as the DOMjudge judgedaemon
+	batch, err := json.Marshal([]domjudgeRun{run})
+	if err != nil {
+		err = errors.Wrap(err, "post result error")
+		return
+	}
+	body := map[string]string{"batch": string(batch)}
+	err = request.Do(ctx, http.MethodPost, fmt.Sprintf("/judgehosts/add-judging-run/%s/%d", url.PathEscape(config.GlobalConfig.HostName), jinfo.JudgingID), body, request.TypeJSON, nil)
+	if err != nil {
+		err = errors.Wrap(err, "post result error")
+		return
+	}
+	// The controller stops judging at the first failed testcase
+	if result.RunResult != config.ResAC && jinfo.Scoring == config.ScoringICPC {
+		s.finish(jinfo)
+	}
+	return
+}
+
+// RecoverJudging never resumes, DOMjudge gives the unfinished judgings of
+// the judgehost back to the queue when it registers
+func (s *DOMjudge) RecoverJudging(ctx context.Context, jinfo config.JudgeInfo, resume bool) (resumed bool, err error) {
+	log.Infof("judging %d is given back to DOMjudge", jinfo.JudgingID)
+	return
+}
+
+// GiveBack registers the judgehost again, DOMjudge gives back all the
+// unfinished judgings of the judgehost then
+func (s *DOMjudge) GiveBack(ctx context.Context, jinfo config.JudgeInfo) (err error) {
+	defer s.finish(jinfo)
+	err = s.Register(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "give back judging error")
+		return
+	}
+	log.Infof("judging %d is given back to DOMjudge", jinfo.JudgingID)
+	return
+}
+
+func (s *DOMjudge) JudgeError(ctx context.Context, jinfo config.JudgeInfo, errMsg error) {
+	// The judgehost is fine when only the server failed to answer, give the
+	// judging back instead of disabling it
+	if _, ok := errors.Cause(errMsg).(*ServerError); ok {
+		log.Warnf("judging %d failed talking to DOMjudge, giving it back: %s", jinfo.JudgingID, errMsg)
+		err := s.GiveBack(ctx, jinfo)
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	}
+	defer s.finish(jinfo)
+	// Disable what is at fault until an admin looks at it, as the DOMjudge
+	// judgedaemon does: the problem for its checker and executables, this
+	// judgehost for the rest
+	kind := map[string]interface{}{"kind": "judgehost", "hostname": config.GlobalConfig.HostName}
+	if _, ok := errors.Cause(errMsg).(*ProblemError); ok {
+		kind = map[string]interface{}{"kind": "problem", "probid": jinfo.ProblemID}
+	}
+	disabled, err := json.Marshal(kind)
+	if err != nil {
+		err = errors.Wrap(err, "post internal error error")
+		log.Error(err)
+		return
+	}
+	info := make(url.Values)
+	info["description"] = []string{errMsg.Error()}
+	info["judgehostlog"] = []string{base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%+v", errMsg)))}
+	info["disabled"] = []string{string(disabled)}
+	info["cid"] = []string{fmt.Sprintf("%d", jinfo.ContestID)}
+	info["judgingid"] = []string{fmt.Sprintf("%d", jinfo.JudgingID)}
+
+	err = request.Do(ctx, http.MethodPost, "/judgehosts/internal-error", info, request.TypeForm, nil)
+	if err != nil {
+		err = errors.Wrap(err, "post internal error error")
+		log.Error(err)
+	}
+	return
+}
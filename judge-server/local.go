@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/VOID001/D-judge/config"
+	"github.com/pkg/errors"
+)
+
+// Executable ids used by the local judge, the build script is named after the language
+const (
+	LocalRunExec     = "run"
+	LocalCompareExec = "compare"
+)
+
+// Local serves a single submission from local files instead of a judge
+// server, the verdicts are printed to Output. It is used by the offline
+// judge mode to validate solutions before uploading them
+type Local struct {
+	// Source is the path of the submitted source code
+	Source string
+	// ExecRoot contains the executables, named <execid>.zip
+	ExecRoot string
+	// Output is where the verdicts are printed
+	Output io.Writer
+
+	mu        sync.Mutex
+	jinfo     config.JudgeInfo
+	fetched   bool
+	testcases []localTestcase
+	next      int
+	verdict   string
+	failed    error
+}
+
+type localTestcase struct {
+	name   string
+	input  string
+	output string
+}
+
+// NewLocal creates a local judge server for the source, testcases are read
+// from testdir, every <name>.in should have a <name>.out or <name>.ans.
+// For group scoring name the testcases as <group>-<name>
+func NewLocal(jinfo config.JudgeInfo, source string, testdir string, execroot string, output io.Writer) (s *Local, err error) {
+	s = &Local{Source: source, ExecRoot: execroot, Output: output, jinfo: jinfo}
+	inputs, err := filepath.Glob(filepath.Join(testdir, "*.in"))
+	if err != nil {
+		err = errors.Wrap(err, "create local judge server error")
+		return
+	}
+	sort.Strings(inputs)
+	for _, in := range inputs {
+		base := strings.TrimSuffix(in, ".in")
+		tc := localTestcase{name: filepath.Base(base), input: in}
+		for _, ext := range []string{".out", ".ans"} {
+			if _, er := os.Stat(base + ext); er == nil {
+				tc.output = base + ext
+				break
+			}
+		}
+		if tc.output == "" {
+			err = errors.New(fmt.Sprintf("create local judge server error: no answer file for %s", in))
+			return
+		}
+		s.testcases = append(s.testcases, tc)
+	}
+	if len(s.testcases) == 0 {
+		err = errors.New(fmt.Sprintf("create local judge server error: no testcase found in %s", testdir))
+		return
+	}
+	return
+}
+
+// Result returns the final verdict of the judging, err is not nil when the
+// judging failed with an internal error
+func (s *Local) Result() (verdict string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	verdict = s.verdict
+	if verdict == "" && s.next == len(s.testcases) {
+		verdict = config.ResAC
+	}
+	err = s.failed
+	return
+}
+
+func (s *Local) Register(ctx context.Context) (err error) {
+	return
+}
+
+func (s *Local) SetActive(ctx context.Context, active bool) (err error) {
+	return
+}
+
+func (s *Local) FetchJudging(ctx context.Context) (jinfo config.JudgeInfo, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetched {
+		return
+	}
+	s.fetched = true
+	jinfo = s.jinfo
+	ok = true
+	return
+}
+
+func (s *Local) FetchTestcase(ctx context.Context, jinfo config.JudgeInfo) (tinfo config.TestcaseInfo, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next >= len(s.testcases) {
+		return
+	}
+	s.next++
+	tinfo = s.testcase(jinfo, s.next)
+	ok = true
+	return
+}
+
+func (s *Local) ListTestcases(ctx context.Context, jinfo config.JudgeInfo) (tinfos []config.TestcaseInfo, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for rank := s.next + 1; rank <= len(s.testcases); rank++ {
+		tinfos = append(tinfos, s.testcase(jinfo, rank))
+	}
+	ok = true
+	return
+}
+
+// testcase returns the info of the testcase of rank, counted from 1
+func (s *Local) testcase(jinfo config.JudgeInfo, rank int) (tinfo config.TestcaseInfo) {
+	tinfo.TestcaseID = int64(rank)
+	tinfo.Rank = int64(rank)
+	tinfo.ProblemID = jinfo.ProblemID
+	// Testcases named <group>-<name> are in the same group
+	tinfo.Group = s.testcases[rank-1].name
+	if i := strings.LastIndex(tinfo.Group, "-"); i > 0 {
+		tinfo.Group = tinfo.Group[:i]
+	}
+	return
+}
+
+func (s *Local) FetchTestcaseFile(ctx context.Context, tinfo config.TestcaseInfo, kind string, dest string) (err error) {
+	if tinfo.TestcaseID < 1 || tinfo.TestcaseID > int64(len(s.testcases)) {
+		err = errors.New(fmt.Sprintf("fetch testcase file error: no testcase %d", tinfo.TestcaseID))
+		return
+	}
+	tc := s.testcases[tinfo.TestcaseID-1]
+	switch kind {
+	case TestcaseInput:
+		err = copyFile(tc.input, dest)
+	case TestcaseOutput:
+		err = copyFile(tc.output, dest)
+	default:
+		err = errors.New(fmt.Sprintf("unknown kind %s", kind))
+	}
+	if err != nil {
+		err = errors.Wrap(err, "fetch testcase file error")
+		return
+	}
+	return
+}
+
+func (s *Local) FetchExecutable(ctx context.Context, execid string, md5sum string, dest string) (err error) {
+	err = copyFile(filepath.Join(s.ExecRoot, execid+".zip"), dest)
+	if err != nil {
+		err = errors.Wrap(err, "fetch executable error")
+		return
+	}
+	return
+}
+
+func (s *Local) FetchSubmission(ctx context.Context, jinfo config.JudgeInfo, dir string) (filename string, err error) {
+	filename = filepath.Base(s.Source)
+	err = copyFile(s.Source, filepath.Join(dir, filename))
+	if err != nil {
+		err = errors.Wrap(err, "fetch submission error")
+		return
+	}
+	return
+}
+
+func (s *Local) CompileResult(ctx context.Context, jinfo config.JudgeInfo, success bool, output string) (err error) {
+	if success {
+		fmt.Fprintf(s.Output, "compile: OK\n")
+		return
+	}
+	s.mu.Lock()
+	s.verdict = config.ResCE
+	s.mu.Unlock()
+	fmt.Fprintf(s.Output, "compile: %s\n%s\n", config.ResCE, output)
+	return
+}
+
+func (s *Local) PostRun(ctx context.Context, jinfo config.JudgeInfo, result config.RunResult) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := ""
+	if result.TestcaseID >= 1 && result.TestcaseID <= int64(len(s.testcases)) {
+		name = s.testcases[result.TestcaseID-1].name
+	}
+	if result.RunResult != config.ResAC && s.verdict == "" {
+		s.verdict = result.RunResult
+	}
+	if jinfo.Scoring != config.ScoringICPC {
+		fmt.Fprintf(s.Output, "testcase %03d %-20s %-16s %.3fs %.2f points\n", result.TestcaseID, name, result.RunResult, result.RunTime, result.Score)
+	} else {
+		fmt.Fprintf(s.Output, "testcase %03d %-20s %-16s %.3fs\n", result.TestcaseID, name, result.RunResult, result.RunTime)
+	}
+	if result.RunResult != config.ResAC && result.OutputError != "" {
+		fmt.Fprintf(s.Output, "%s\n", result.OutputError)
+	}
+	return
+}
+
+func (s *Local) PostScore(ctx context.Context, jinfo config.JudgeInfo, score float64) (err error) {
+	fmt.Fprintf(s.Output, "score: %.2f\n", score)
+	return
+}
+
+func (s *Local) RecoverJudging(ctx context.Context, jinfo config.JudgeInfo, resume bool) (resumed bool, err error) {
+	return
+}
+
+// GiveBack fails the judging, the offline judge is interrupted
+func (s *Local) GiveBack(ctx context.Context, jinfo config.JudgeInfo) (err error) {
+	s.mu.Lock()
+	s.failed = errors.New("judging canceled")
+	s.mu.Unlock()
+	return
+}
+
+func (s *Local) JudgeError(ctx context.Context, jinfo config.JudgeInfo, errMsg error) {
+	s.mu.Lock()
+	s.failed = errMsg
+	s.mu.Unlock()
+	fmt.Fprintf(s.Output, "judge error: %s\n", errMsg.Error())
+	return
+}
+
+func copyFile(src string, dest string) (err error) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(dest, data, 0644)
+	return
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/VOID001/D-judge/config"
+	"github.com/VOID001/D-judge/downloader"
+	"github.com/VOID001/D-judge/request"
+	"github.com/pkg/errors"
+)
+
+// NEUOJ speaks the NEUOJ judgehost API, which is compatible with the old
+// (DOMjudge 5) judgehost API
+type NEUOJ struct{}
+
+func (s *NEUOJ) Register(ctx context.Context) (err error) {
+	err = request.Do(ctx, http.MethodPost, "/judgehosts", url.Values{"hostname": {config.GlobalConfig.HostName}}, request.TypeForm, nil)
+	if err != nil {
+		err = errors.Wrap(err, "register judgehost error")
+		return
+	}
+	return
+}
+
+func (s *NEUOJ) SetActive(ctx context.Context, active bool) (err error) {
+	info := make(url.Values)
+
+	info["hostname"] = []string{config.GlobalConfig.HostName}
+	info["active"] = []string{"0"}
+	if active {
+		info["active"] = []string{"1"}
+	}
+	err = request.Do(ctx, http.MethodPut, "/judgehosts", info, request.TypeForm, nil)
+	if err != nil {
+		err = errors.Wrap(err, "set judgehost active error")
+		return
+	}
+	return
+}
+
+func (s *NEUOJ) FetchJudging(ctx context.Context) (jinfo config.JudgeInfo, ok bool, err error) {
+	err = request.Do(ctx, http.MethodPost, fmt.Sprintf("/judgings?judgehost=%s", config.GlobalConfig.HostName), nil, "", &jinfo)
+	if err != nil {
+		err = errors.Wrap(err, "fetch judging error")
+		return
+	}
+	ok = jinfo.SubmitID != 0
+	return
+}
+
+func (s *NEUOJ) FetchTestcase(ctx context.Context, jinfo config.JudgeInfo) (tinfo config.TestcaseInfo, ok bool, err error) {
+	// NEUOJ identify the testcases by submit id
+	err = request.Do(ctx, http.MethodGet, fmt.Sprintf("/testcases?judgingid=%d", jinfo.SubmitID), nil, "", &tinfo)
+	if err != nil {
+		err = errors.Wrap(err, "fetch testcase error")
+		return
+	}
+	ok = tinfo.TestcaseID != 0
+	return
+}
+
+// ListTestcases lists the next testcase only, NEUOJ tells no more until the
+// run of it is reported. So the first testcase is downloaded while
+// building, the others before their runs
+func (s *NEUOJ) ListTestcases(ctx context.Context, jinfo config.JudgeInfo) (tinfos []config.TestcaseInfo, ok bool, err error) {
+	tinfo, more, err := s.FetchTestcase(ctx, jinfo)
+	if err != nil {
+		err = errors.Wrap(err, "list testcases error")
+		return
+	}
+	if more {
+		tinfos = append(tinfos, tinfo)
+	}
+	ok = true
+	return
+}
+
+func (s *NEUOJ) FetchTestcaseFile(ctx context.Context, tinfo config.TestcaseInfo, kind string, dest string) (err error) {
+	d := downloader.Downloader{
+		URL:          fmt.Sprintf("/testcase_files?testcaseid=%d&%s", tinfo.TestcaseID, kind),
+		Destination:  dest,
+		SkipMD5Check: false,
+		UseCache:     true,
+	}
+	switch kind {
+	case TestcaseInput:
+		d.FileName = fmt.Sprintf("%d.in", tinfo.TestcaseID)
+		d.MD5 = tinfo.MD5SumInput
+	case TestcaseOutput:
+		d.FileName = fmt.Sprintf("%d.out", tinfo.TestcaseID)
+		d.MD5 = tinfo.MD5SumOutput
+	default:
+		err = errors.New(fmt.Sprintf("fetch testcase file error: unknown kind %s", kind))
+		return
+	}
+	err = d.Do(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "fetch testcase file error")
+		return
+	}
+	return
+}
+
+func (s *NEUOJ) FetchExecutable(ctx context.Context, execid string, md5sum string, dest string) (err error) {
+	d := downloader.Downloader{
+		URL:          fmt.Sprintf("/executable?execid=%s", execid),
+		FileName:     execid,
+		Destination:  dest,
+		SkipMD5Check: false,
+		MD5:          md5sum,
+		UseCache:     true,
+	}
+	err = d.Do(ctx)
+	if err != nil {
+		err = errors.Wrap(err, "fetch executable error")
+		return
+	}
+	return
+}
+
+func (s *NEUOJ) FetchSubmission(ctx context.Context, jinfo config.JudgeInfo, dir string) (filename string, err error) {
+	m := []map[string]string{}
+	err = request.Do(ctx, http.MethodGet, fmt.Sprintf("/submission_files?id=%d", jinfo.SubmitID), nil, "", &m)
+	if err != nil {
+		err = errors.Wrap(err, "fetch submission error")
+		return
+	}
+	if len(m) == 0 {
+		err = errors.New("fetch submission error: no submission file")
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(m[0]["content"])
+	if err != nil {
+		err = errors.Wrap(err, "fetch submission error")
+		return
+	}
+	filename = m[0]["filename"]
+	err = ioutil.WriteFile(filepath.Join(dir, filename), data, downloader.FilePerm)
+	if err != nil {
+		err = errors.Wrap(err, "fetch submission error")
+		return
+	}
+	return
+}
+
+func (s *NEUOJ) CompileResult(ctx context.Context, jinfo config.JudgeInfo, success bool, output string) (err error) {
+	info := make(url.Values)
+
+	info["compile_success"] = []string{"0"}
+	if success {
+		info["compile_success"] = []string{"1"}
+	}
+	info["output_compile"] = []string{base64.StdEncoding.EncodeToString([]byte(output))}
+	info["judgehost"] = []string{config.GlobalConfig.HostName}
+
+	// NEUOJ identify the judging by submit id here
+	err = request.Do(ctx, http.MethodPut, fmt.Sprintf("/judgings/%d", jinfo.SubmitID), info, request.TypeForm, nil)
+	if err != nil {
+		err = errors.Wrap(err, "put compile result error")
+		return
+	}
+	return
+}
+
+func (s *NEUOJ) PostRun(ctx context.Context, jinfo config.JudgeInfo, result config.RunResult) (err error) {
+	info := make(url.Values)
+
+	info["judgingid"] = []string{fmt.Sprintf("%d", result.JudgingID)}
+	info["testcaseid"] = []string{fmt.Sprintf("%d", result.TestcaseID)}
+	info["runresult"] = []string{mapVerdict(domjudgeVerdicts, result.RunResult)}
+	info["runtime"] = []string{fmt.Sprintf("%f", result.RunTime)}
+	info["judgehost"] = []string{config.GlobalConfig.HostName}
+	info["output_run"] = []string{base64.StdEncoding.EncodeToString([]byte(result.OutputRun))}
+	info["output_error"] = []string{base64.StdEncoding.EncodeToString([]byte(result.OutputError))}
+	info["output_system"] = []string{base64.StdEncoding.EncodeToString([]byte(result.OutputSystem))}
+	info["output_diff"] = []string{base64.StdEncoding.EncodeToString([]byte(result.OutputDiff))}
+	if jinfo.Scoring != config.ScoringICPC {
+		info["score"] = []string{fmt.Sprintf("%f", result.Score)}
+	}
+
+	err = request.Do(ctx, http.MethodPost, "/judging_runs", info, request.TypeForm, nil)
+	if err != nil {
+		err = errors.Wrap(err, "post result error")
+		return
+	}
+	return
+}
+
+func (s *NEUOJ) RecoverJudging(ctx context.Context, jinfo config.JudgeInfo, resume bool) (resumed bool, err error) {
+	// NEUOJ hands out the testcases not reported yet, so the judging can
+	// simply be judged again. Otherwise report it as error, NEUOJ never
+	// gives out a judging twice
+	if resume {
+		resumed = true
+		return
+	}
+	s.JudgeError(ctx, jinfo, errors.New("judgehost restarted in the middle of judging"))
+	return
+}
+
+// GiveBack does nothing, NEUOJ never gives out a judging twice. The judging
+// is recovered on next start
+func (s *NEUOJ) GiveBack(ctx context.Context, jinfo config.JudgeInfo) (err error) {
+	return
+}
+
+func (s *NEUOJ) JudgeError(ctx context.Context, jinfo config.JudgeInfo, errMsg error) {
+	info := make(url.Values)
+
+	// For backward(domjudge) compability, set judge error as compile error
+	info["compile_success"] = []string{"0"}
+	info["output_compile"] = []string{base64.StdEncoding.EncodeToString([]byte(errMsg.Error()))}
+	info["judgehost"] = []string{config.GlobalConfig.HostName}
+
+	err := request.Do(ctx, http.MethodPut, fmt.Sprintf("/judgings/%d", jinfo.JudgingID), info, request.TypeForm, nil)
+	if err != nil {
+		err = errors.Wrap(err, "put judging errors error")
+		log.Error(err)
+	}
+	return
+}
@@ -0,0 +1,125 @@
+// Package server defines how the judgehost talks to a judge server, every
+// supported judge server protocol is one implementation of JudgeServer
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/VOID001/D-judge/config"
+	"github.com/pkg/errors"
+)
+
+// Supported judge server types, set endpoint_type in config to select one
+const (
+	TypeNEUOJ    = "neuoj"
+	TypeDOMjudge = "domjudge"
+)
+
+// Testcase file kinds used by FetchTestcaseFile
+const (
+	TestcaseInput  = "input"
+	TestcaseOutput = "output"
+)
+
+// domjudgeVerdicts maps our verdicts to the ones known by DOMjudge (and
+// NEUOJ, which follows the DOMjudge 5 API), the others are sent as they are.
+// The system output of a restricted function run tells it from run error
+var domjudgeVerdicts = map[string]string{
+	config.ResPE: config.ResWA,
+	config.ResRF: config.ResRE,
+}
+
+// mapVerdict maps verdict with m, verdicts not in m are kept
+func mapVerdict(m map[string]string, verdict string) string {
+	if v, ok := m[verdict]; ok {
+		return v
+	}
+	return verdict
+}
+
+// ProblemError is a judge error caused by the problem, like its checker
+// exiting with an unexpected code or an executable failing to build. The
+// other judge errors are of the judgehost
+type ProblemError struct {
+	Err error
+}
+
+func (e *ProblemError) Error() string {
+	return e.Err.Error()
+}
+
+// ServerError is a judge error caused by talking to the judge server, like a
+// failed download or a request the server did not take. Nothing is at fault
+// locally, so the judging is given back to be judged again if possible
+type ServerError struct {
+	Err error
+}
+
+func (e *ServerError) Error() string {
+	return e.Err.Error()
+}
+
+// JudgeServer is the interface every judge server backend should implement,
+// the judge controller only talks to the server through it
+type JudgeServer interface {
+	// Register tells the server this judgehost is alive
+	Register(ctx context.Context) (err error)
+	// SetActive marks the judgehost active or not, the server gives no
+	// judging to an inactive judgehost
+	SetActive(ctx context.Context, active bool) (err error)
+	// FetchJudging requests a new judging, ok is false when there is nothing to judge
+	FetchJudging(ctx context.Context) (jinfo config.JudgeInfo, ok bool, err error)
+	// FetchTestcase gets the next testcase to run for the judging, ok is false when all testcases are done
+	FetchTestcase(ctx context.Context, jinfo config.JudgeInfo) (tinfo config.TestcaseInfo, ok bool, err error)
+	// ListTestcases lists the testcases of the judging not fetched yet, so
+	// their files can be downloaded ahead. ok is false if the server does
+	// not tell them in advance, FetchTestcase still gives them one by one.
+	// A server may list only the first of them
+	ListTestcases(ctx context.Context, jinfo config.JudgeInfo) (tinfos []config.TestcaseInfo, ok bool, err error)
+	// FetchTestcaseFile downloads the input or output file of the testcase to dest
+	FetchTestcaseFile(ctx context.Context, tinfo config.TestcaseInfo, kind string, dest string) (err error)
+	// FetchExecutable downloads the executable zip (build, run and compare script) to dest
+	FetchExecutable(ctx context.Context, execid string, md5sum string, dest string) (err error)
+	// FetchSubmission downloads the submitted source code into dir and returns its file name
+	FetchSubmission(ctx context.Context, jinfo config.JudgeInfo, dir string) (filename string, err error)
+	// CompileResult reports the compile result, output is the compiler message
+	CompileResult(ctx context.Context, jinfo config.JudgeInfo, success bool, output string) (err error)
+	// PostRun reports the result of one testcase run, the backend maps the
+	// verdict to one the server knows
+	PostRun(ctx context.Context, jinfo config.JudgeInfo, result config.RunResult) (err error)
+	// RecoverJudging handles a judging left unfinished by a crash of the
+	// judgehost, resumed is true if the judging should be judged again by
+	// this host, otherwise it is given back to the server or reported as error
+	RecoverJudging(ctx context.Context, jinfo config.JudgeInfo, resume bool) (resumed bool, err error)
+	// GiveBack gives a judging canceled by a drain back to the server to be
+	// judged again, a server can not take it back does nothing and it is
+	// recovered with RecoverJudging on next start
+	GiveBack(ctx context.Context, jinfo config.JudgeInfo) (err error)
+	// JudgeError reports an internal error happened during judging, errors
+	// happened when reporting are only logged. A *ProblemError (as the cause
+	// of errMsg) tells the fault of the problem from the one of the judgehost,
+	// a *ServerError is no fault of either
+	JudgeError(ctx context.Context, jinfo config.JudgeInfo, errMsg error)
+}
+
+// ScoreReporter is implemented by the backends taking the total points of a
+// judging with partial scoring, PostScore is called after all testcases are
+// run. Only the offline judge does, NEUOJ takes the points of every run with
+// PostRun and DOMjudge has no partial scoring
+type ScoreReporter interface {
+	PostScore(ctx context.Context, jinfo config.JudgeInfo, score float64) (err error)
+}
+
+// New creates the judge server backend selected by cfg.EndpointType
+func New(cfg config.SystemConfig) (s JudgeServer, err error) {
+	switch cfg.EndpointType {
+	case "", TypeNEUOJ:
+		s = &NEUOJ{}
+	case TypeDOMjudge:
+		s = &DOMjudge{}
+	default:
+		err = errors.New(fmt.Sprintf("create judge server error: unsupported endpoint type %s", cfg.EndpointType))
+	}
+	return
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/VOID001/D-judge/config"
+	"github.com/pkg/errors"
+)
+
+var GlobalConfig = config.SystemConfig{
+	HostName:         "judge-01",
+	EndpointName:     "neuoj",
+	EndpointUser:     "neuoj",
+	EndpointPassword: "neuoj",
+	JudgeRoot:        "/tmp/judge_root",
+	CacheRoot:        "/tmp/cache_root",
+}
+
+func init() {
+	config.GlobalConfig = GlobalConfig
+	log.SetLevel(log.DebugLevel)
+}
+
+func TestNEUOJFetchJudging(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/judgings" || req.URL.Query().Get("judgehost") != "judge-01" {
+			t.Logf("unexpected request %s", req.URL)
+			t.Fail()
+		}
+		fmt.Fprint(rw, `{"submitid": 3, "judgingid": 5, "langid": "c", "maxruntime": 2}`)
+	}))
+	defer ts.Close()
+	config.GlobalConfig.EndpointURL = ts.URL
+
+	s := NEUOJ{}
+	jinfo, ok, err := s.FetchJudging(context.Background())
+	if err != nil {
+		t.Logf("fetch judging error: %+v", err)
+		t.Fail()
+		return
+	}
+	if !ok || jinfo.SubmitID != 3 || jinfo.JudgingID != 5 || jinfo.TimeLimit != 2 {
+		t.Logf("unexpected judge info %+v", jinfo)
+		t.Fail()
+		return
+	}
+}
+
+func TestNEUOJPostRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.URL.Path != "/judging_runs" || req.Form.Get("runresult") != config.ResAC {
+			t.Logf("unexpected request %s %+v", req.URL, req.Form)
+			t.Fail()
+		}
+		diff, _ := base64.StdEncoding.DecodeString(req.Form.Get("output_diff"))
+		if string(diff) != "diff" {
+			t.Logf("unexpected output_diff %s", diff)
+			t.Fail()
+		}
+	}))
+	defer ts.Close()
+	config.GlobalConfig.EndpointURL = ts.URL
+
+	s := NEUOJ{}
+	res := config.RunResult{JudgingID: 5, TestcaseID: 1, RunResult: config.ResAC, OutputDiff: "diff"}
+	err := s.PostRun(context.Background(), config.JudgeInfo{JudgingID: 5}, res)
+	if err != nil {
+		t.Logf("post run error: %+v", err)
+		t.Fail()
+		return
+	}
+}
+
+func TestNEUOJListTestcases(t *testing.T) {
+	next := `{"testcaseid": 11, "rank": 1}`
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/testcases" || req.URL.Query().Get("judgingid") != "3" {
+			t.Logf("unexpected request %s", req.URL)
+			t.Fail()
+		}
+		fmt.Fprint(rw, next)
+	}))
+	defer ts.Close()
+	config.GlobalConfig.EndpointURL = ts.URL
+
+	s := NEUOJ{}
+	jinfo := config.JudgeInfo{SubmitID: 3, JudgingID: 5}
+	tinfos, ok, err := s.ListTestcases(context.Background(), jinfo)
+	if err != nil || !ok || len(tinfos) != 1 || tinfos[0].TestcaseID != 11 {
+		t.Logf("expected the next testcase listed, got %+v ok = %v err = %+v", tinfos, ok, err)
+		t.Fail()
+	}
+	// All testcases are run
+	next = `{"testcaseid": 0}`
+	tinfos, ok, err = s.ListTestcases(context.Background(), jinfo)
+	if err != nil || !ok || len(tinfos) != 0 {
+		t.Logf("expected no testcase listed, got %+v ok = %v err = %+v", tinfos, ok, err)
+		t.Fail()
+	}
+}
+
+func TestNEUOJScore(t *testing.T) {
+	requests := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		requests = append(requests, fmt.Sprintf("%s %s score=%s", req.Method, req.URL.Path, req.Form.Get("score")))
+	}))
+	defer ts.Close()
+	config.GlobalConfig.EndpointURL = ts.URL
+
+	s := NEUOJ{}
+	jinfo := config.JudgeInfo{SubmitID: 3, JudgingID: 5, Scoring: config.ScoringSum}
+	res := config.RunResult{JudgingID: 5, TestcaseID: 1, RunResult: config.ResWA, Score: 0.5}
+	err := s.PostRun(context.Background(), jinfo, res)
+	// The points go with the run, there is no request for the total
+	want := []string{"POST /judging_runs score=0.500000"}
+	if err != nil || fmt.Sprint(requests) != fmt.Sprint(want) {
+		t.Logf("expected requests %v, got %v error %+v", want, requests, err)
+		t.Fail()
+	}
+	if _, ok := interface{}(&s).(ScoreReporter); ok {
+		t.Logf("NEUOJ takes no total points")
+		t.Fail()
+	}
+}
+
+func TestNEUOJPostRunVerdict(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("runresult") != config.ResWA {
+			t.Logf("presentation-error should be sent as %s, got %s", config.ResWA, req.Form.Get("runresult"))
+			t.Fail()
+		}
+	}))
+	defer ts.Close()
+	config.GlobalConfig.EndpointURL = ts.URL
+
+	s := NEUOJ{}
+	res := config.RunResult{JudgingID: 5, TestcaseID: 1, RunResult: config.ResPE}
+	err := s.PostRun(context.Background(), config.JudgeInfo{JudgingID: 5}, res)
+	if err != nil {
+		t.Logf("post run error: %+v", err)
+		t.Fail()
+		return
+	}
+}
+
+func TestDOMjudgeFetchJudging(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/judgehosts/next-judging/judge-01" {
+			t.Logf("unexpected request %s", req.URL)
+			t.Fail()
+		}
+		fmt.Fprint(rw, `{"submitid": "3", "judgingid": 5, "langid": "cpp", "maxruntime": 1.5, "memlimit": 262144,
+			"run": "run", "compare": "compare", "compile_script": "cpp",
+			"testcases": {"2": {"testcaseid": "8", "rank": "2", "md5sum_input": "a", "md5sum_output": "b"},
+				"1": {"testcaseid": 7, "rank": 1, "md5sum_input": "c", "md5sum_output": "d", "judgetaskid": 11}}}`)
+	}))
+	defer ts.Close()
+	config.GlobalConfig.EndpointURL = ts.URL
+
+	s := DOMjudge{}
+	jinfo, ok, err := s.FetchJudging(context.Background())
+	if err != nil {
+		t.Logf("fetch judging error: %+v", err)
+		t.Fail()
+		return
+	}
+	if !ok || jinfo.SubmitID != 3 || jinfo.JudgingID != 5 || jinfo.TimeLimit != 1.5 || jinfo.BuildZip != "cpp" {
+		t.Logf("unexpected judge info %+v", jinfo)
+		t.Fail()
+		return
+	}
+	for _, id := range []int64{7, 8} {
+		tinfo, ok, err := s.FetchTestcase(context.Background(), jinfo)
+		if err != nil || !ok || tinfo.TestcaseID != id {
+			t.Logf("unexpected testcase %+v ok = %v err = %+v", tinfo, ok, err)
+			t.Fail()
+			return
+		}
+	}
+	_, ok, err = s.FetchTestcase(context.Background(), jinfo)
+	if err != nil || ok {
+		t.Logf("expected no more testcase, ok = %v err = %+v", ok, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestDOMjudgeFetchNoJudging(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(rw, `""`)
+	}))
+	defer ts.Close()
+	config.GlobalConfig.EndpointURL = ts.URL
+
+	s := DOMjudge{}
+	_, ok, err := s.FetchJudging(context.Background())
+	if err != nil || ok {
+		t.Logf("expected no judging, ok = %v err = %+v", ok, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestDOMjudgeJudgeError(t *testing.T) {
+	var disabled []string
+	registered := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.URL.Path == "/judgehosts" {
+			registered++
+			fmt.Fprint(rw, `[]`)
+			return
+		}
+		if req.URL.Path != "/judgehosts/internal-error" || req.Form.Get("judgingid") != "5" {
+			t.Logf("unexpected request %s %v", req.URL, req.Form)
+			t.Fail()
+		}
+		disabled = append(disabled, req.Form.Get("disabled"))
+	}))
+	defer ts.Close()
+	config.GlobalConfig.EndpointURL = ts.URL
+
+	s := DOMjudge{}
+	jinfo := config.JudgeInfo{JudgingID: 5, ProblemID: 7}
+	s.JudgeError(context.Background(), jinfo, errors.Wrap(&ProblemError{Err: errors.New("checker return unexpected exit code 1")}, "worker error"))
+	s.JudgeError(context.Background(), jinfo, errors.New("create container error"))
+	s.JudgeError(context.Background(), jinfo, errors.Wrap(&ServerError{Err: errors.New("connection refused")}, "fetch testcase error"))
+	want := []string{`{"kind":"problem","probid":7}`, `{"hostname":"judge-01","kind":"judgehost"}`}
+	if fmt.Sprint(disabled) != fmt.Sprint(want) || registered != 1 {
+		t.Logf("expected disabled %v and the server error given back, got %v registered %d times", want, disabled, registered)
+		t.Fail()
+	}
+}
+
+func TestDOMjudgeGiveBack(t *testing.T) {
+	registered := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Method != http.MethodPost || req.URL.Path != "/judgehosts" || req.Form.Get("hostname") != "judge-01" {
+			t.Logf("unexpected request %s %s %v", req.Method, req.URL, req.Form)
+			t.Fail()
+		}
+		registered++
+		fmt.Fprint(rw, `[{"judgingid": 5}]`)
+	}))
+	defer ts.Close()
+	config.GlobalConfig.EndpointURL = ts.URL
+
+	s := DOMjudge{}
+	err := s.GiveBack(context.Background(), config.JudgeInfo{JudgingID: 5})
+	if err != nil || registered != 1 {
+		t.Logf("give back registered %d times, error %+v", registered, err)
+		t.Fail()
+	}
+}
+
+func TestLocalJudging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "djudge-local")
+	if err != nil {
+		t.Logf("create temp dir error: %+v", err)
+		t.Fail()
+		return
+	}
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"1.in", "1.out", "2.in", "2.ans", "a.cpp"} {
+		ioutil.WriteFile(filepath.Join(dir, f), []byte(f), 0644)
+	}
+
+	out := bytes.Buffer{}
+	s, err := NewLocal(config.JudgeInfo{JudgingID: 1}, filepath.Join(dir, "a.cpp"), dir, dir, &out)
+	if err != nil {
+		t.Logf("create local judge server error: %+v", err)
+		t.Fail()
+		return
+	}
+	jinfo, ok, err := s.FetchJudging(context.Background())
+	if err != nil || !ok {
+		t.Logf("expected a judging, ok = %v err = %+v", ok, err)
+		t.Fail()
+		return
+	}
+	// Skip the first testcase
+	s.FetchTestcase(context.Background(), jinfo)
+	tinfo, ok, err := s.FetchTestcase(context.Background(), jinfo)
+	if err != nil || !ok || tinfo.Rank != 2 {
+		t.Logf("unexpected testcase %+v ok = %v err = %+v", tinfo, ok, err)
+		t.Fail()
+		return
+	}
+	dest := filepath.Join(dir, "dest")
+	err = s.FetchTestcaseFile(context.Background(), tinfo, TestcaseOutput, dest)
+	data, _ := ioutil.ReadFile(dest)
+	if err != nil || string(data) != "2.ans" {
+		t.Logf("unexpected testcase output %s, err = %+v", data, err)
+		t.Fail()
+		return
+	}
+	s.PostRun(context.Background(), jinfo, config.RunResult{TestcaseID: 2, RunResult: config.ResWA})
+	verdict, err := s.Result()
+	if err != nil || verdict != config.ResWA {
+		t.Logf("unexpected result %s, err = %+v", verdict, err)
+		t.Fail()
+		return
+	}
+}
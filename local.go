@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/VOID001/D-judge/config"
+	"github.com/VOID001/D-judge/judge-controller"
+	"github.com/VOID001/D-judge/judge-server"
+	"github.com/pkg/errors"
+)
+
+// Exit code of the offline judge mode
+const (
+	ExitAccepted    = 0 // All testcases are correct
+	ExitRejected    = 1 // Judged with a verdict other than correct
+	ExitJudgeError  = 2 // Judging failed with an internal error
+	ExitBadArgument = 3 // Invalid command line arguments
+)
+
+// localJudge judges a single submission against local testcases, usage:
+// D-judge [-c config.toml] judge --source a.cpp --lang cpp --tests ./tests --time 2 --mem 256M
+func localJudge(args []string) (code int) {
+	var source, lang, tests, execroot, mem, output, scoring string
+	var timelim float64
+	var interactive bool
+	fs := flag.NewFlagSet("judge", flag.ContinueOnError)
+	fs.StringVar(&source, "source", "", "source code to judge")
+	fs.StringVar(&lang, "lang", "", "language of the source, its build script is <exec>/<lang>.zip")
+	fs.StringVar(&tests, "tests", "", "directory contains <name>.in and <name>.out (or <name>.ans) testcases")
+	fs.StringVar(&execroot, "exec", GlobalConfig.LocalExecRoot, "directory contains <lang>.zip, run.zip and compare.zip")
+	fs.Float64Var(&timelim, "time", 1, "time limit in seconds")
+	fs.StringVar(&mem, "mem", "512M", "memory limit, K, M and G suffix are supported")
+	fs.StringVar(&output, "output", "8M", "output limit, K, M and G suffix are supported")
+	fs.BoolVar(&interactive, "interactive", false, "interactive problem, compare.zip is the interactor")
+	fs.StringVar(&scoring, "scoring", config.ScoringICPC, "partial scoring policy, sum or group, every testcase has 1 point")
+	err := fs.Parse(args)
+	if err != nil {
+		return ExitBadArgument
+	}
+	if source == "" || lang == "" || tests == "" || execroot == "" {
+		fmt.Fprintf(os.Stderr, "judge: --source, --lang, --tests and --exec (or local_exec_root in config) are required\n")
+		fs.Usage()
+		return ExitBadArgument
+	}
+	memlim, err := parseSize(mem)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "judge: invalid --mem: %s\n", err)
+		return ExitBadArgument
+	}
+	outputlim, err := parseSize(output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "judge: invalid --output: %s\n", err)
+		return ExitBadArgument
+	}
+
+	// Keep the verdicts readable unless debug is asked for
+	if debuglv == INFO {
+		log.SetLevel(log.WarnLevel)
+	}
+	sandbox, err := sanityCheckSandbox()
+	if err != nil {
+		err = errors.Wrap(err, "sanity check sandbox error")
+		log.Fatal(err)
+	}
+
+	jinfo := config.JudgeInfo{
+		SubmitID:    time.Now().Unix(),
+		JudgingID:   time.Now().Unix(),
+		Language:    lang,
+		TimeLimit:   timelim,
+		MemLimit:    memlim / 1024,
+		OutputLimit: outputlim / 1024,
+		BuildZip:    lang,
+		RunZip:      server.LocalRunExec,
+		CompareZip:  server.LocalCompareExec,
+
+		CombinedRunCompare: interactive,
+		Scoring:            scoring,
+	}
+	srv, err := server.NewLocal(jinfo, source, tests, execroot, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "judge: %s\n", err)
+		return ExitBadArgument
+	}
+
+	workDir := filepath.Join(config.GlobalConfig.JudgeRoot, fmt.Sprintf("local-%d", time.Now().UnixNano()))
+	err = os.Mkdir(workDir, DirPerm)
+	if err != nil {
+		err = errors.Wrap(err, "create work dir error")
+		log.Fatal(err)
+	}
+	fmt.Printf("judging %s (%s), work dir %s\n", source, lang, workDir)
+
+	// A core of judge_cpus not reserved, as the judgehost runs judgings on
+	cpus, err := controller.NewCPUAllocator(config.GlobalConfig.JudgeCPUs, config.GlobalConfig.ReservedCPUs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "judge: %s\n", err)
+		return ExitJudgeError
+	}
+	cpuid, err := cpus.Get()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "judge: %s\n", err)
+		return ExitJudgeError
+	}
+
+	daemon := controller.Daemon{}
+	daemon.Server = srv
+	daemon.Sandbox = sandbox
+	jinfo, _, _ = srv.FetchJudging(context.Background())
+	daemon.Judge(context.Background(), jinfo, workDir, config.GlobalConfig.DockerImage, cpuid)
+
+	verdict, err := srv.Result()
+	if err != nil {
+		fmt.Printf("result: judge error\n")
+		return ExitJudgeError
+	}
+	fmt.Printf("result: %s\n", verdict)
+	if verdict != config.ResAC {
+		return ExitRejected
+	}
+	return ExitAccepted
+}
+
+// parseSize parses size like 256M into bytes
+func parseSize(str string) (size int64, err error) {
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(str, "K"):
+		unit = 1024
+	case strings.HasSuffix(str, "M"):
+		unit = 1024 * 1024
+	case strings.HasSuffix(str, "G"):
+		unit = 1024 * 1024 * 1024
+	}
+	if unit != 1 {
+		str = str[:len(str)-1]
+	}
+	size, err = strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return
+	}
+	size *= unit
+	return
+}
@@ -4,21 +4,21 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"math/rand"
-	"runtime"
 	"time"
 
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/BurntSushi/toml"
 	log "github.com/Sirupsen/logrus"
 	"github.com/VOID001/D-judge/config"
+	"github.com/VOID001/D-judge/downloader"
 	"github.com/VOID001/D-judge/judge-controller"
-	"github.com/VOID001/D-judge/request"
+	"github.com/VOID001/D-judge/judge-server"
 
 	"github.com/pkg/errors"
 )
@@ -31,6 +31,9 @@ const (
 	DirPerm = 0744 // Dir Permission
 )
 
+// DefaultDrainTimeout is used when drain_timeout is not set
+const DefaultDrainTimeout = 10 * time.Minute
+
 // Error constants
 const (
 	ErrNoDir  = "no such file or directory"
@@ -64,6 +67,9 @@ func init() {
 	if !filepath.IsAbs(GlobalConfig.CacheRoot) {
 		GlobalConfig.CacheRoot = filepath.Join(cwd, GlobalConfig.CacheRoot)
 	}
+	if GlobalConfig.LocalExecRoot != "" && !filepath.IsAbs(GlobalConfig.LocalExecRoot) {
+		GlobalConfig.LocalExecRoot = filepath.Join(cwd, GlobalConfig.LocalExecRoot)
+	}
 	if debuglv == INFO {
 		log.SetLevel(log.InfoLevel)
 	}
@@ -93,54 +99,111 @@ func main() {
 		err = errors.Wrap(err, "sanity check dir cacheroot error")
 		log.Fatal(err)
 	}
+	// Offline judge mode, judge local files without the judge server
+	if flag.Arg(0) == "judge" {
+		os.Exit(localJudge(flag.Args()[1:]))
+	}
 	err = sanityCheckConnection(GlobalConfig.EndpointURL)
 	if err != nil {
 		err = errors.Wrap(err, "sanity check connection error")
 		log.Fatal(err)
 	}
-	err = sanityCheckDocker()
+	sandbox, err := sanityCheckSandbox()
 	if err != nil {
-		err = errors.Wrap(err, "sanity check docker error")
+		err = errors.Wrap(err, "sanity check sandbox error")
+		log.Fatal(err)
+	}
+
+	srv, err := server.New(GlobalConfig)
+	if err != nil {
+		err = errors.Wrap(err, "main loop error")
 		log.Fatal(err)
 	}
 
 	// Error When Requesting Judgehost
-	err = request.Do(context.Background(), http.MethodPost, "/judgehosts", url.Values{"hostname": {config.GlobalConfig.HostName}}, request.TypeForm, nil)
+	err = srv.Register(context.Background())
 	if err != nil {
 		err = errors.Wrap(err, "main loop error")
 		log.Fatal(err)
 	}
 	log.Infof("sanity check success")
+	// It may be marked inactive by the last shutdown
+	err = srv.SetActive(context.Background(), true)
+	if err != nil {
+		err = errors.Wrap(err, "main loop error")
+		log.Fatal(err)
+	}
 
 	// PerformRequest Lifcycle
 	daemon := controller.Daemon{}
-	daemon.MaxWorker = runtime.NumCPU()
-	daemon.Run(context.Background())
-	for {
-		jinfo := config.JudgeInfo{}
-		// Request For Judge
-		err = request.Do(context.Background(), http.MethodPost, fmt.Sprintf("/judgings?judgehost=%s", config.GlobalConfig.HostName), nil, "", &jinfo)
-		if err != nil {
-			log.Warn(err)
-		}
-		log.Debugf("Judge Info %+v", jinfo)
-		if jinfo.SubmitID != 0 {
-			log.Infof("Fetched Submission ID #%d", jinfo.SubmitID)
-			workDir := fmt.Sprintf("%s/c%d-s%d-j%d", config.GlobalConfig.JudgeRoot, jinfo.ContestID, jinfo.SubmitID, jinfo.JudgingID)
-			if _, err := os.Stat(workDir); err == nil {
-				oldWorkDir := fmt.Sprintf("%s-old-%d", workDir, time.Now().Unix())
-				log.Infof("Found stale working directory, rename to %s", oldWorkDir)
-				err := os.Rename(workDir, oldWorkDir)
-				if err != nil {
-					err = errors.Wrap(err, "main loop error")
-					log.Fatal(err)
-				}
-			}
-			os.Mkdir(workDir, DirPerm)
-			daemon.AddTask(context.Background(), jinfo, workDir, config.GlobalConfig.DockerImage)
+	daemon.Server = srv
+	daemon.Pools = GlobalConfig.Pools
+	daemon.Sandbox = sandbox
+	daemon.JournalDir = filepath.Join(GlobalConfig.JudgeRoot, "journal")
+	err = sanityCheckDir(daemon.JournalDir)
+	if err != nil {
+		err = errors.Wrap(err, "sanity check dir journal error")
+		log.Fatal(err)
+	}
+	err = daemon.Run(context.Background())
+	if err != nil {
+		err = errors.Wrap(err, "main loop error")
+		log.Fatal(err)
+	}
+	// Clean up what is left by the last crash
+	err = daemon.Recover(context.Background(), GlobalConfig.ResumeJudgings)
+	if err != nil {
+		err = errors.Wrap(err, "main loop error")
+		log.Fatal(err)
+	}
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	var sig os.Signal
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sig = <-stop
+		cancel()
+	}()
+	if docker, ok := sandbox.(*controller.DockerClient); ok {
+		go docker.Watch(ctx)
+	}
+	// Request For Judge until stopped
+	daemon.Fetch(ctx, config.GlobalConfig.DockerImage)
+	shutdown(srv, &daemon, sig, stop)
+}
+
+// shutdown stops the judgehost gracefully, the judgings in progress are
+// waited for at most drain_timeout seconds, or until another signal comes
+func shutdown(srv server.JudgeServer, daemon *controller.Daemon, sig os.Signal, stop chan os.Signal) {
+	log.Infof("received signal %s, shutting down", sig)
+	err := srv.SetActive(context.Background(), false)
+	if err != nil {
+		log.Error(errors.Wrap(err, "shutdown error"))
+	}
+	timeout := time.Duration(GlobalConfig.DrainTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-stop:
+			log.Warnf("received signal %s again, stop draining", sig)
+			cancel()
+		case <-ctx.Done():
 		}
-		time.Sleep(time.Duration(rand.Intn(2500)) * time.Millisecond)
+	}()
+	err = daemon.Drain(ctx)
+	// The last uses of the cache hits are saved lazily
+	if er := downloader.FlushCache(); er != nil {
+		log.Error(errors.Wrap(er, "shutdown error"))
+	}
+	if err != nil {
+		log.Error(errors.Wrap(err, "shutdown error"))
+		return
 	}
+	log.Infof("all judgings done, bye")
 }
 
 func sanityCheckDir(dir string) (err error) {
@@ -180,8 +243,39 @@ func sanityCheckConnection(endpoint string) (err error) {
 	return
 }
 
-func sanityCheckDocker() (err error) {
-	err = controller.Ping(context.Background())
+// sanityCheckSandbox sets up the sandbox backend of the config
+func sanityCheckSandbox() (sandbox controller.Sandbox, err error) {
+	switch GlobalConfig.Sandbox {
+	case "", config.SandboxDocker:
+		docker, er := sanityCheckDocker()
+		if er != nil {
+			err = er
+			return
+		}
+		sandbox = docker
+		return
+	case config.SandboxNamespace:
+		cgroup := GlobalConfig.SandboxCgroup
+		if cgroup == "" {
+			cgroup = filepath.Join(controller.CgroupRoot, "d-judge")
+		}
+		sandbox, err = controller.NewNamespaceSandbox(GlobalConfig.SandboxRootfs, cgroup, filepath.Join(GlobalConfig.JudgeRoot, "nsbox"))
+		if err != nil {
+			err = errors.Wrap(err, "namespace sandbox error")
+		}
+		return
+	}
+	err = errors.New(fmt.Sprintf("unknown sandbox %s", GlobalConfig.Sandbox))
+	return
+}
+
+func sanityCheckDocker() (docker *controller.DockerClient, err error) {
+	docker, err = controller.NewDockerClient(context.Background())
+	if err != nil {
+		err = errors.Wrap(err, "docker connect error")
+		return
+	}
+	err = docker.Ping(context.Background())
 	if err != nil {
 		err = errors.Wrap(err, "docker Ping error")
 	}
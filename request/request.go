@@ -3,7 +3,6 @@ package request
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -20,6 +19,8 @@ const (
 	TypeJSON = "application/json"
 )
 
+// Do send a request to the judge server endpoint, data is encoded as ctype and
+// the JSON response is decoded into respdata
 func Do(ctx context.Context, method string, URL string, data interface{}, ctype string, respdata interface{}) (err error) {
 	log.Debugf("Do(%v %v %v %v %v %v)", ctx, method, URL, data, ctype, respdata)
 	req := new(http.Request)
@@ -96,77 +97,32 @@ func Do(ctx context.Context, method string, URL string, data interface{}, ctype
 	return
 }
 
-func JudgeError(ctx context.Context, errMsg error, jid int64) {
-	info := make(url.Values)
-
-	// Encode error to base64 string
-
-	// For backward(domjudge) compability, set judge error as compile error
-	data := base64.StdEncoding.EncodeToString([]byte(errMsg.Error()))
-	info["compile_success"] = []string{"0"}
-	info["output_compile"] = []string{data}
-	info["judgehost"] = []string{config.GlobalConfig.HostName}
-
-	err := Do(ctx, http.MethodPut, fmt.Sprintf("/judgings/%d", jid), info, TypeForm, nil)
-	if err != nil {
-		err = errors.Wrap(err, "put Judging Errors error")
-		log.Error(err)
-	}
-	return
-}
-
-func CompileError(ctx context.Context, compileErr error, jid int64) (err error) {
-	info := make(url.Values)
-
-	// Encode error to base64 string
-
-	// For backward(domjudge) compability, set judge error as compile error
-	data := base64.StdEncoding.EncodeToString([]byte(compileErr.Error()))
-	info["compile_success"] = []string{"0"}
-	info["output_compile"] = []string{data}
-	info["judgehost"] = []string{config.GlobalConfig.HostName}
-
-	err = Do(ctx, http.MethodPut, fmt.Sprintf("/judgings/%d", jid), info, TypeForm, nil)
+// Open sends a GET request to the judge server endpoint, the response body
+// is streamed by the caller, who closes it
+func Open(ctx context.Context, URL string) (resp *http.Response, err error) {
+	URL = config.GlobalConfig.EndpointURL + URL
+	log.Debugf("stared request method=%s URL=%s", http.MethodGet, URL)
+	req, err := http.NewRequest(http.MethodGet, URL, nil)
 	if err != nil {
-		err = errors.Wrap(err, "put Compile Errors error")
+		err = errors.Wrap(err, "open request error")
 		return
 	}
-	return
-
-}
-
-func CompileOK(ctx context.Context, jid int64) (err error) {
-	info := make(url.Values)
-
-	info["compile_success"] = []string{"1"}
-	info["output_compile"] = []string{""}
-	info["judgehost"] = []string{config.GlobalConfig.HostName}
+	req = req.WithContext(ctx)
+	req.Header.Add("X-Djudge-Hostname", config.GlobalConfig.HostName)
+	req.SetBasicAuth(config.GlobalConfig.EndpointUser, config.GlobalConfig.EndpointPassword)
 
-	err = Do(ctx, http.MethodPut, fmt.Sprintf("/judgings/%d", jid), info, TypeForm, nil)
+	cli := &http.Client{}
+	resp, err = cli.Do(req)
 	if err != nil {
-		err = errors.Wrap(err, "put Compile OK error")
+		err = errors.Wrap(err, fmt.Sprintf("request error method=%s URL=%s", http.MethodGet, URL))
 		return
 	}
-	return
-
-}
-
-func PostResult(ctx context.Context, result config.RunResult) (err error) {
-	info := make(url.Values)
-
-	info["judgingid"] = []string{fmt.Sprintf("%d", result.JudgingID)}
-	info["testcaseid"] = []string{fmt.Sprintf("%d", result.TestcaseID)}
-	info["runresult"] = []string{result.RunResult}
-	info["runtime"] = []string{fmt.Sprintf("%lf", result.RunTime)}
-	info["judgehost"] = []string{config.GlobalConfig.HostName}
-	info["output_run"] = []string{base64.StdEncoding.EncodeToString([]byte(result.OutputRun))}
-	info["output_error"] = []string{base64.StdEncoding.EncodeToString([]byte(result.OutputError))}
-	info["output_system"] = []string{base64.StdEncoding.EncodeToString([]byte(result.OutputSystem))}
-	info["output_diff"] = []string{base64.StdEncoding.EncodeToString([]byte(result.OutputDiff))}
-
-	err = Do(ctx, http.MethodPost, "/judging_runs", info, TypeForm, nil)
-	if err != nil {
-		err = errors.Wrap(err, "Post result error")
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		tmpbuf := bytes.Buffer{}
+		tmpbuf.ReadFrom(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		err = errors.New(fmt.Sprintf("request error status code %d data\n %s", resp.StatusCode, tmpbuf.String()))
+		resp = nil
 		return
 	}
 	return